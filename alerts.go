@@ -0,0 +1,503 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ==================== ALERTING ====================
+// Rules are conditions over the monitor metrics or a service state, e.g.
+// "disk.used_percent > 90 for 5m" or "service nginx != active". A rule whose
+// condition holds is pending until it has held for its duration, then
+// firing; it resolves when the condition clears. Every firing and
+// resolution is kept in the alert history and sent to the rule's channels
+// unless a silence covers it.
+
+const (
+	defaultAlertEvalSeconds = 15 // Override with ALERT_EVAL_SECONDS
+	defaultAlertHistoryDays = 90 // ALERT_HISTORY_DAYS, 0 keeps everything
+)
+
+// AlertRule is an admin-defined condition
+type AlertRule struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	Name      string    `json:"name"`
+	Expr      string    `json:"expr"`     // Condition without the "for" part
+	For       int64     `json:"for"`      // Seconds the condition must hold before firing
+	Severity  string    `json:"severity"` // Free text, "warning" by default
+	Channels  string    `json:"channels"` // Comma separated channel ids, empty for every enabled channel
+	Enabled   bool      `json:"enabled"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AlertSilence mutes notifications for one rule (or all when RuleID is 0)
+type AlertSilence struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	RuleID    uint      `gorm:"index" json:"rule_id"`
+	StartsAt  time.Time `json:"starts_at"`
+	EndsAt    time.Time `gorm:"index" json:"ends_at"`
+	Comment   string    `json:"comment"`
+	CreatedBy uint      `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AlertEvent is one state change in the alert history
+type AlertEvent struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	RuleID    uint      `gorm:"index" json:"rule_id"`
+	RuleName  string    `json:"rule_name"`
+	State     string    `json:"state"` // firing or resolved
+	Value     string    `json:"value"` // Value that triggered or cleared the condition
+	Message   string    `json:"message"`
+	Silenced  bool      `json:"silenced"`
+	Notified  string    `json:"notified"`   // Delivery result per channel
+	StartedAt time.Time `json:"started_at"` // When the condition started holding
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+}
+
+// alertCondition is a parsed rule expression
+type alertCondition struct {
+	Metric    string // Monitor metric, see metricsSampler.sample
+	Service   string // Set for service conditions
+	Op        string
+	Threshold float64
+	State     string // Wanted (or unwanted) service state
+}
+
+var (
+	alertMetricExpr  = regexp.MustCompile(`^([a-z0-9_.]+)\s*(>=|<=|==|!=|>|<)\s*(-?[0-9.]+)$`)
+	alertServiceExpr = regexp.MustCompile(`^service\s+([A-Za-z0-9@._][A-Za-z0-9@._-]*)\s*(==|!=)\s*([a-z-]+)$`) // No leading "-": it would read as an option
+	alertForSuffix   = regexp.MustCompile(`\s+for\s+(\S+)$`)
+)
+
+// parseAlertExpr parses a condition with an optional "for <duration>" suffix
+func parseAlertExpr(expr string) (*alertCondition, time.Duration, error) {
+	expr = strings.TrimSpace(expr)
+	var holdFor time.Duration
+	if m := alertForSuffix.FindStringSubmatch(expr); m != nil {
+		d, err := time.ParseDuration(m[1])
+		if err != nil || d < 0 {
+			return nil, 0, fmt.Errorf("invalid duration %q", m[1])
+		}
+		holdFor = d
+		expr = strings.TrimSpace(expr[:len(expr)-len(m[0])])
+	}
+
+	if m := alertServiceExpr.FindStringSubmatch(expr); m != nil {
+		return &alertCondition{Service: m[1], Op: m[2], State: m[3]}, holdFor, nil
+	}
+	if m := alertMetricExpr.FindStringSubmatch(expr); m != nil {
+		threshold, err := strconv.ParseFloat(m[3], 64)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid threshold %q", m[3])
+		}
+		return &alertCondition{Metric: m[1], Op: m[2], Threshold: threshold}, holdFor, nil
+	}
+	return nil, 0, errors.New(`expected "<metric> <op> <number>" or "service <name> ==|!= <state>"`)
+}
+
+// eval checks the condition against a metrics sample and service states
+func (cond *alertCondition) eval(sample map[string]float64, serviceState func(string) string) (bool, string, error) {
+	if cond.Service != "" {
+		state := serviceState(cond.Service)
+		if cond.Op == "==" {
+			return state == cond.State, state, nil
+		}
+		return state != cond.State, state, nil
+	}
+
+	v, ok := sample[cond.Metric]
+	if !ok {
+		return false, "", fmt.Errorf("no value for metric %s", cond.Metric)
+	}
+	value := strconv.FormatFloat(math.Round(v*100)/100, 'f', -1, 64)
+	switch cond.Op {
+	case ">":
+		return v > cond.Threshold, value, nil
+	case ">=":
+		return v >= cond.Threshold, value, nil
+	case "<":
+		return v < cond.Threshold, value, nil
+	case "<=":
+		return v <= cond.Threshold, value, nil
+	case "==":
+		return v == cond.Threshold, value, nil
+	}
+	return v != cond.Threshold, value, nil
+}
+
+// alertState is the live state of one rule
+type alertState struct {
+	State string    `json:"state"` // inactive, pending or firing
+	Since time.Time `json:"since"` // When the condition started holding
+	Value string    `json:"value"`
+	Error string    `json:"error,omitempty"`
+}
+
+var alertStates = struct {
+	sync.Mutex
+	m map[uint]*alertState
+}{m: make(map[uint]*alertState)}
+
+func initAlerts() {
+	// Rules that were firing when the server stopped carry on firing, so
+	// their resolution still gets sent
+	var rules []AlertRule
+	DB.Find(&rules)
+	for _, rule := range rules {
+		var last AlertEvent
+		if DB.Where("rule_id = ?", rule.ID).Order("id desc").First(&last).Error == nil && last.State == "firing" {
+			alertStates.m[rule.ID] = &alertState{State: "firing", Since: last.StartedAt, Value: last.Value}
+		}
+	}
+	go alertEvaluator()
+}
+
+func alertEvaluator() {
+	lastPrune := time.Time{}
+	for {
+		interval := getSettingInt("ALERT_EVAL_SECONDS", defaultAlertEvalSeconds)
+		if interval <= 0 {
+			interval = defaultAlertEvalSeconds
+		}
+		time.Sleep(time.Duration(interval) * time.Second)
+		evaluateAlerts(time.Duration(interval) * time.Second)
+
+		if time.Since(lastPrune) > time.Hour {
+			lastPrune = time.Now()
+			if days := getSettingInt("ALERT_HISTORY_DAYS", defaultAlertHistoryDays); days > 0 {
+				DB.Where("created_at < ?", time.Now().AddDate(0, 0, -int(days))).Delete(&AlertEvent{})
+			}
+			DB.Where("ends_at < ?", time.Now()).Delete(&AlertSilence{})
+		}
+	}
+}
+
+// evaluateAlerts runs every enabled rule once against the metrics history's
+// latest sample, taking one itself only if that is older than maxAge
+func evaluateAlerts(maxAge time.Duration) {
+	var rules []AlertRule
+	DB.Where("enabled = ?", true).Order("id asc").Find(&rules)
+	if len(rules) == 0 {
+		return
+	}
+	now := time.Now()
+	sample := currentMetrics(maxAge)
+
+	services := make(map[string]string)
+	serviceState := func(name string) string {
+		if state, ok := services[name]; ok {
+			return state
+		}
+		out, _ := exec.Command("systemctl", "is-active", "--", name).Output() // Exit code 3 means inactive
+		state := strings.TrimSpace(string(out))
+		if state == "" {
+			state = "unknown"
+		}
+		services[name] = state
+		return state
+	}
+
+	for _, rule := range rules {
+		cond, _, err := parseAlertExpr(rule.Expr)
+		var holds bool
+		var value string
+		if err == nil {
+			holds, value, err = cond.eval(sample, serviceState)
+		}
+
+		alertStates.Lock()
+		st := alertStates.m[rule.ID]
+		if st == nil {
+			st = &alertState{State: "inactive"}
+			alertStates.m[rule.ID] = st
+		}
+		st.Error = ""
+		if err != nil {
+			st.Error = err.Error()
+			alertStates.Unlock()
+			continue // Keep the state rather than resolving on a missing value
+		}
+		st.Value = value
+		var transition string
+		switch {
+		case holds && st.State == "inactive":
+			st.State, st.Since = "pending", now
+			if rule.For <= 0 {
+				st.State, transition = "firing", "firing"
+			}
+		case holds && st.State == "pending" && now.Sub(st.Since) >= time.Duration(rule.For)*time.Second:
+			st.State, transition = "firing", "firing"
+		case !holds && st.State == "pending":
+			st.State = "inactive"
+		case !holds && st.State == "firing":
+			st.State, transition = "inactive", "resolved"
+		}
+		since := st.Since
+		alertStates.Unlock()
+
+		if transition != "" {
+			recordAlert(rule, transition, value, since)
+		}
+	}
+}
+
+// resetAlertState forgets a rule's live state. A firing alert is resolved
+// rather than dropped, so receivers aren't left with an alert that never clears.
+func resetAlertState(rule AlertRule) {
+	alertStates.Lock()
+	st := alertStates.m[rule.ID]
+	delete(alertStates.m, rule.ID)
+	alertStates.Unlock()
+	if st != nil && st.State == "firing" {
+		recordAlert(rule, "resolved", st.Value, st.Since)
+	}
+}
+
+// alertSilenced reports whether an active silence covers rule
+func alertSilenced(ruleID uint) bool {
+	now := time.Now()
+	var count int64
+	DB.Model(&AlertSilence{}).Where("(rule_id = 0 OR rule_id = ?) AND starts_at <= ? AND ends_at > ?", ruleID, now, now).Count(&count)
+	return count > 0
+}
+
+// recordAlert stores a state change and notifies the rule's channels
+func recordAlert(rule AlertRule, state, value string, since time.Time) {
+	severity := rule.Severity
+	if severity == "" {
+		severity = "warning"
+	}
+	condition := rule.Expr
+	if rule.For > 0 {
+		condition += " for " + (time.Duration(rule.For) * time.Second).String()
+	}
+	event := AlertEvent{
+		RuleID:    rule.ID,
+		RuleName:  rule.Name,
+		State:     state,
+		Value:     value,
+		Message:   fmt.Sprintf("[%s] %s (%s): %s, value %s", strings.ToUpper(state), rule.Name, severity, condition, value),
+		Silenced:  alertSilenced(rule.ID),
+		StartedAt: since,
+		CreatedAt: time.Now(),
+	}
+	DB.Create(&event)
+	log.Println("alerts:", event.Message)
+	if event.Silenced {
+		return
+	}
+
+	channels := alertChannelsFor(rule)
+	if len(channels) == 0 {
+		DB.Model(&event).Update("notified", "no channels")
+		return
+	}
+	go func() {
+		var results []string
+		for _, ch := range channels {
+			result := "ok"
+			if err := sendAlert(ch, &event, severity); err != nil {
+				result = err.Error()
+				log.Printf("alerts: %s channel %q failed: %v", ch.Type, ch.Name, err)
+			}
+			results = append(results, fmt.Sprintf("%s: %s", ch.Name, result))
+		}
+		DB.Model(&event).Update("notified", strings.Join(results, "; "))
+	}()
+}
+
+// ==================== ALERT API ====================
+
+type alertRuleStatus struct {
+	AlertRule
+	alertState
+}
+
+// GetAlerts lists the rules with their live state
+func GetAlerts(c *fiber.Ctx) error {
+	var rules []AlertRule
+	DB.Order("id asc").Find(&rules)
+	list := make([]alertRuleStatus, 0, len(rules))
+	alertStates.Lock()
+	for _, rule := range rules {
+		status := alertRuleStatus{AlertRule: rule, alertState: alertState{State: "inactive"}}
+		if st := alertStates.m[rule.ID]; st != nil && rule.Enabled {
+			status.alertState = *st
+		}
+		if !rule.Enabled {
+			status.State = "disabled"
+		}
+		list = append(list, status)
+	}
+	alertStates.Unlock()
+	return c.JSON(fiber.Map{"rules": list})
+}
+
+// GetAlertHistory returns state changes, newest first.
+// GET /api/alerts/history?rule=3&limit=100
+func GetAlertHistory(c *fiber.Ctx) error {
+	limit := c.QueryInt("limit", 100)
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	q := DB.Order("id desc").Limit(limit)
+	if rule := c.QueryInt("rule", 0); rule > 0 {
+		q = q.Where("rule_id = ?", rule)
+	}
+	var events []AlertEvent
+	q.Find(&events)
+	return c.JSON(events)
+}
+
+// checkAlertRule validates a rule, moving a "for" suffix into For
+func checkAlertRule(rule *AlertRule) error {
+	if rule.Name == "" {
+		return errors.New("name required")
+	}
+	_, holdFor, err := parseAlertExpr(rule.Expr)
+	if err != nil {
+		return fmt.Errorf("invalid expression: %v", err)
+	}
+	if m := alertForSuffix.FindStringSubmatch(strings.TrimSpace(rule.Expr)); m != nil {
+		rule.Expr = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(rule.Expr), m[0]))
+		rule.For = int64(holdFor / time.Second)
+	}
+	if rule.For < 0 {
+		return errors.New("for must not be negative")
+	}
+	if rule.Severity == "" {
+		rule.Severity = "warning"
+	}
+	for _, id := range strings.Split(rule.Channels, ",") {
+		if id = strings.TrimSpace(id); id == "" {
+			continue
+		}
+		var count int64
+		DB.Model(&AlertChannel{}).Where("id = ?", id).Count(&count)
+		if count == 0 {
+			return fmt.Errorf("unknown channel %s", id)
+		}
+	}
+	return nil
+}
+
+func CreateAlertRule(c *fiber.Ctx) error {
+	rule := AlertRule{Enabled: true}
+	if err := c.BodyParser(&rule); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Invalid input"})
+	}
+	rule.ID = 0
+	rule.CreatedAt = time.Now()
+	if err := checkAlertRule(&rule); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": err.Error()})
+	}
+	DB.Create(&rule)
+	return c.JSON(rule)
+}
+
+func UpdateAlertRule(c *fiber.Ctx) error {
+	var rule AlertRule
+	if err := DB.First(&rule, c.Params("id")).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": "Rule not found"})
+	}
+	old := rule
+	id, created := rule.ID, rule.CreatedAt
+	if err := c.BodyParser(&rule); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Invalid input"})
+	}
+	rule.ID, rule.CreatedAt = id, created
+	if err := checkAlertRule(&rule); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": err.Error()})
+	}
+	DB.Save(&rule)
+	if rule.Expr != old.Expr || rule.For != old.For || !rule.Enabled {
+		resetAlertState(old) // A new condition starts over
+	}
+	return c.JSON(rule)
+}
+
+func DeleteAlertRule(c *fiber.Ctx) error {
+	var rule AlertRule
+	if err := DB.First(&rule, c.Params("id")).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": "Rule not found"})
+	}
+	DB.Delete(&rule)
+	DB.Where("rule_id = ?", rule.ID).Delete(&AlertSilence{})
+	resetAlertState(rule)
+	return c.JSON(fiber.Map{"message": "Rule deleted"})
+}
+
+// GetAlertSilences lists silences that haven't ended
+func GetAlertSilences(c *fiber.Ctx) error {
+	var silences []AlertSilence
+	DB.Where("ends_at > ?", time.Now()).Order("ends_at asc").Find(&silences)
+	return c.JSON(silences)
+}
+
+// CreateAlertSilence takes rule_id (0 for all rules), comment and either
+// ends_at or duration ("2h")
+func CreateAlertSilence(c *fiber.Ctx) error {
+	var body struct {
+		RuleID   uint      `json:"rule_id"`
+		StartsAt time.Time `json:"starts_at"`
+		EndsAt   time.Time `json:"ends_at"`
+		Duration string    `json:"duration"`
+		Comment  string    `json:"comment"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Invalid input"})
+	}
+	now := time.Now()
+	if body.StartsAt.IsZero() {
+		body.StartsAt = now
+	}
+	if body.Duration != "" {
+		d, err := time.ParseDuration(body.Duration)
+		if err != nil || d <= 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Invalid duration"})
+		}
+		body.EndsAt = body.StartsAt.Add(d)
+	}
+	if !body.EndsAt.After(body.StartsAt) || !body.EndsAt.After(now) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "ends_at or duration required, in the future"})
+	}
+	if body.RuleID != 0 {
+		var count int64
+		DB.Model(&AlertRule{}).Where("id = ?", body.RuleID).Count(&count)
+		if count == 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Rule not found"})
+		}
+	}
+
+	claims := c.Locals("user").(jwt.MapClaims)
+	userIdFloat, _ := claims["iss"].(float64)
+	silence := AlertSilence{
+		RuleID:    body.RuleID,
+		StartsAt:  body.StartsAt,
+		EndsAt:    body.EndsAt,
+		Comment:   body.Comment,
+		CreatedBy: uint(userIdFloat),
+		CreatedAt: now,
+	}
+	DB.Create(&silence)
+	return c.JSON(silence)
+}
+
+func DeleteAlertSilence(c *fiber.Ctx) error {
+	if err := DB.Delete(&AlertSilence{}, c.Params("id")).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Failed to delete silence"})
+	}
+	return c.JSON(fiber.Map{"message": "Silence deleted"})
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ==================== ALERT CHANNELS ====================
+// Where alerts are delivered: a generic JSON webhook, a Slack-compatible
+// incoming webhook (Slack, Mattermost, Rocket.Chat), an ntfy topic or mail
+// over SMTP. Every channel can be sent a test notification from the API.
+
+const alertSendTimeout = 10 * time.Second
+
+// AlertChannel is a notification target. Config holds the type's settings:
+//
+//	webhook: url, headers (object)
+//	slack:   url
+//	ntfy:    url (server, default https://ntfy.sh), topic, token
+//	smtp:    host, port (default 587), username, password, from, to (comma separated)
+type AlertChannel struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
+	Config    string    `json:"config"` // JSON object
+	Enabled   bool      `json:"enabled"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+var alertChannelTypes = map[string]func(cfg map[string]interface{}, event *AlertEvent, severity string) error{
+	"webhook": sendWebhookAlert,
+	"slack":   sendSlackAlert,
+	"ntfy":    sendNtfyAlert,
+	"smtp":    sendSMTPAlert,
+}
+
+var alertHTTPClient = &http.Client{Timeout: alertSendTimeout}
+
+// alertChannelsFor returns the enabled channels a rule notifies
+func alertChannelsFor(rule AlertRule) []AlertChannel {
+	var channels []AlertChannel
+	q := DB.Where("enabled = ?", true)
+	var ids []string
+	for _, id := range strings.Split(rule.Channels, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) > 0 {
+		q = q.Where("id IN ?", ids)
+	}
+	q.Order("id asc").Find(&channels)
+	return channels
+}
+
+func sendAlert(ch AlertChannel, event *AlertEvent, severity string) error {
+	send, ok := alertChannelTypes[ch.Type]
+	if !ok {
+		return fmt.Errorf("unknown channel type %q", ch.Type)
+	}
+	cfg := map[string]interface{}{}
+	if ch.Config != "" {
+		if err := json.Unmarshal([]byte(ch.Config), &cfg); err != nil {
+			return fmt.Errorf("invalid config: %v", err)
+		}
+	}
+	return send(cfg, event, severity)
+}
+
+func configString(cfg map[string]interface{}, key, def string) string {
+	switch v := cfg[key].(type) {
+	case string:
+		if v != "" {
+			return v
+		}
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return def
+}
+
+// postAlert sends body and fails on any non-2xx answer
+func postAlert(url, contentType string, body []byte, headers map[string]string) error {
+	if url == "" {
+		return errors.New("url required")
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := alertHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+func sendWebhookAlert(cfg map[string]interface{}, event *AlertEvent, severity string) error {
+	body, _ := json.Marshal(map[string]interface{}{
+		"rule_id":    event.RuleID,
+		"rule":       event.RuleName,
+		"state":      event.State,
+		"severity":   severity,
+		"value":      event.Value,
+		"message":    event.Message,
+		"started_at": event.StartedAt,
+		"at":         event.CreatedAt,
+	})
+	headers := map[string]string{}
+	if h, ok := cfg["headers"].(map[string]interface{}); ok {
+		for k, v := range h {
+			headers[k] = fmt.Sprint(v)
+		}
+	}
+	return postAlert(configString(cfg, "url", ""), "application/json", body, headers)
+}
+
+func sendSlackAlert(cfg map[string]interface{}, event *AlertEvent, severity string) error {
+	icon := ":rotating_light:"
+	if event.State == "resolved" {
+		icon = ":white_check_mark:"
+	}
+	body, _ := json.Marshal(map[string]string{"text": icon + " " + event.Message})
+	return postAlert(configString(cfg, "url", ""), "application/json", body, nil)
+}
+
+func sendNtfyAlert(cfg map[string]interface{}, event *AlertEvent, severity string) error {
+	topic := configString(cfg, "topic", "")
+	if topic == "" {
+		return errors.New("topic required")
+	}
+	headers := map[string]string{
+		"Title":    fmt.Sprintf("%s: %s", strings.ToUpper(event.State), event.RuleName),
+		"Priority": "high",
+		"Tags":     "rotating_light",
+	}
+	if event.State == "resolved" {
+		headers["Priority"], headers["Tags"] = "default", "white_check_mark"
+	}
+	if token := configString(cfg, "token", ""); token != "" {
+		headers["Authorization"] = "Bearer " + token
+	}
+	server := strings.TrimRight(configString(cfg, "url", "https://ntfy.sh"), "/")
+	return postAlert(server+"/"+topic, "text/plain", []byte(event.Message), headers)
+}
+
+func sendSMTPAlert(cfg map[string]interface{}, event *AlertEvent, severity string) error {
+	host := configString(cfg, "host", "")
+	from := configString(cfg, "from", "")
+	var to []string
+	for _, addr := range strings.Split(configString(cfg, "to", ""), ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			to = append(to, addr)
+		}
+	}
+	if host == "" || from == "" || len(to) == 0 {
+		return errors.New("host, from and to required")
+	}
+	addr := net.JoinHostPort(host, configString(cfg, "port", "587"))
+
+	var auth smtp.Auth
+	if user := configString(cfg, "username", ""); user != "" {
+		auth = smtp.PlainAuth("", user, configString(cfg, "password", ""), host)
+	}
+	subject := fmt.Sprintf("[%s] %s", strings.ToUpper(event.State), event.RuleName)
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+		from, strings.Join(to, ", "), subject, event.CreatedAt.Format(time.RFC1123Z), event.Message)
+
+	// smtp.SendMail has no timeout of its own
+	done := make(chan error, 1)
+	go func() { done <- smtp.SendMail(addr, auth, from, to, []byte(msg)) }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(alertSendTimeout):
+		return fmt.Errorf("timed out connecting to %s", addr)
+	}
+}
+
+// ==================== ALERT CHANNEL API ====================
+
+func GetAlertChannels(c *fiber.Ctx) error {
+	var channels []AlertChannel
+	DB.Order("id asc").Find(&channels)
+	return c.JSON(channels)
+}
+
+func checkAlertChannel(ch *AlertChannel) error {
+	if ch.Name == "" {
+		return errors.New("name required")
+	}
+	if _, ok := alertChannelTypes[ch.Type]; !ok {
+		return fmt.Errorf("type must be webhook, slack, ntfy or smtp")
+	}
+	if ch.Config != "" {
+		var cfg map[string]interface{}
+		if err := json.Unmarshal([]byte(ch.Config), &cfg); err != nil {
+			return fmt.Errorf("config must be a JSON object: %v", err)
+		}
+	}
+	return nil
+}
+
+// parseAlertChannel accepts config as a JSON object or as a string holding one
+func parseAlertChannel(c *fiber.Ctx, ch *AlertChannel) error {
+	var body map[string]json.RawMessage
+	if err := json.Unmarshal(c.Body(), &body); err != nil {
+		return err
+	}
+	if raw, ok := body["config"]; ok && len(raw) > 0 && raw[0] == '{' {
+		ch.Config = string(raw)
+		delete(body, "config")
+	}
+	rest, _ := json.Marshal(body)
+	return json.Unmarshal(rest, ch)
+}
+
+func CreateAlertChannel(c *fiber.Ctx) error {
+	ch := AlertChannel{Enabled: true}
+	if err := parseAlertChannel(c, &ch); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Invalid input"})
+	}
+	ch.ID = 0
+	ch.CreatedAt = time.Now()
+	if err := checkAlertChannel(&ch); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": err.Error()})
+	}
+	DB.Create(&ch)
+	return c.JSON(ch)
+}
+
+func UpdateAlertChannel(c *fiber.Ctx) error {
+	var ch AlertChannel
+	if err := DB.First(&ch, c.Params("id")).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": "Channel not found"})
+	}
+	id, created := ch.ID, ch.CreatedAt
+	if err := parseAlertChannel(c, &ch); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Invalid input"})
+	}
+	ch.ID, ch.CreatedAt = id, created
+	if err := checkAlertChannel(&ch); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": err.Error()})
+	}
+	DB.Save(&ch)
+	return c.JSON(ch)
+}
+
+// DeleteAlertChannel refuses channels a rule still lists: dropping the id
+// would leave the rule notifying nobody, or every channel if it was the only one
+func DeleteAlertChannel(c *fiber.Ctx) error {
+	var ch AlertChannel
+	if err := DB.First(&ch, c.Params("id")).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": "Channel not found"})
+	}
+	var rules []AlertRule
+	DB.Where("channels <> ''").Order("id asc").Find(&rules)
+	var users []string
+	for _, rule := range rules {
+		for _, id := range strings.Split(rule.Channels, ",") {
+			if strings.TrimSpace(id) == strconv.FormatUint(uint64(ch.ID), 10) {
+				users = append(users, rule.Name)
+				break
+			}
+		}
+	}
+	if len(users) > 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"message": "Channel is used by alert rules: " + strings.Join(users, ", "),
+			"rules":   users,
+		})
+	}
+	if err := DB.Delete(&ch).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Failed to delete channel"})
+	}
+	return c.JSON(fiber.Map{"message": "Channel deleted"})
+}
+
+// TestAlertChannel sends a test notification through a channel, enabled or not
+func TestAlertChannel(c *fiber.Ctx) error {
+	var ch AlertChannel
+	if err := DB.First(&ch, c.Params("id")).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": "Channel not found"})
+	}
+	now := time.Now()
+	event := &AlertEvent{
+		RuleName:  "Test notification",
+		State:     "firing",
+		Value:     "1",
+		Message:   fmt.Sprintf("[TEST] Test notification from Vibeserver channel %q", ch.Name),
+		StartedAt: now,
+		CreatedAt: now,
+	}
+	if err := sendAlert(ch, event, "info"); err != nil {
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{"message": err.Error()})
+	}
+	return c.JSON(fiber.Map{"message": "Test notification sent"})
+}
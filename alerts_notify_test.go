@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// capturedRequest is what a stand-in receiver saw of one POST
+type capturedRequest struct {
+	path   string
+	header http.Header
+	body   []byte
+}
+
+// alertReceiver answers every request with status and hands it to the test
+func alertReceiver(t *testing.T, status int) (*httptest.Server, <-chan capturedRequest) {
+	t.Helper()
+	requests := make(chan capturedRequest, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- capturedRequest{path: r.URL.Path, header: r.Header, body: body}
+		w.WriteHeader(status)
+		io.WriteString(w, "receiver says no")
+	}))
+	t.Cleanup(srv.Close)
+	return srv, requests
+}
+
+func testAlertEvent(state string) *AlertEvent {
+	at := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	return &AlertEvent{
+		RuleID:    7,
+		RuleName:  "Disk full",
+		State:     state,
+		Value:     "93.5",
+		Message:   "[" + strings.ToUpper(state) + "] Disk full (critical): disk.used_percent > 90, value 93.5",
+		StartedAt: at.Add(-5 * time.Minute),
+		CreatedAt: at,
+	}
+}
+
+func TestSendWebhookAlert(t *testing.T) {
+	srv, requests := alertReceiver(t, http.StatusOK)
+	cfg := map[string]interface{}{"url": srv.URL + "/hook", "headers": map[string]interface{}{"X-Token": "secret"}}
+	if err := sendWebhookAlert(cfg, testAlertEvent("firing"), "critical"); err != nil {
+		t.Fatal(err)
+	}
+
+	req := <-requests
+	if req.path != "/hook" {
+		t.Errorf("path %s, want /hook", req.path)
+	}
+	if got := req.header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type %q", got)
+	}
+	if got := req.header.Get("X-Token"); got != "secret" {
+		t.Errorf("X-Token %q, want the configured header", got)
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal(req.body, &payload); err != nil {
+		t.Fatalf("payload is not JSON: %v", err)
+	}
+	for key, want := range map[string]interface{}{
+		"rule_id":    float64(7),
+		"rule":       "Disk full",
+		"state":      "firing",
+		"severity":   "critical",
+		"value":      "93.5",
+		"started_at": "2026-10-18T11:55:00Z",
+		"at":         "2026-10-18T12:00:00Z",
+	} {
+		if payload[key] != want {
+			t.Errorf("payload %s = %v, want %v", key, payload[key], want)
+		}
+	}
+}
+
+func TestSendSlackAlert(t *testing.T) {
+	srv, requests := alertReceiver(t, http.StatusOK)
+	cfg := map[string]interface{}{"url": srv.URL}
+	for state, icon := range map[string]string{"firing": ":rotating_light:", "resolved": ":white_check_mark:"} {
+		event := testAlertEvent(state)
+		if err := sendSlackAlert(cfg, event, "critical"); err != nil {
+			t.Fatal(err)
+		}
+		req := <-requests
+		var payload map[string]string
+		if err := json.Unmarshal(req.body, &payload); err != nil {
+			t.Fatalf("payload is not JSON: %v", err)
+		}
+		if want := icon + " " + event.Message; payload["text"] != want {
+			t.Errorf("%s: text %q, want %q", state, payload["text"], want)
+		}
+	}
+}
+
+func TestSendNtfyAlert(t *testing.T) {
+	srv, requests := alertReceiver(t, http.StatusOK)
+	cfg := map[string]interface{}{"url": srv.URL + "/", "topic": "ops", "token": "tk_123"}
+	event := testAlertEvent("firing")
+	if err := sendNtfyAlert(cfg, event, "critical"); err != nil {
+		t.Fatal(err)
+	}
+	req := <-requests
+	if req.path != "/ops" {
+		t.Errorf("path %s, want /ops", req.path)
+	}
+	for name, want := range map[string]string{
+		"Content-Type":  "text/plain",
+		"Title":         "FIRING: Disk full",
+		"Priority":      "high",
+		"Tags":          "rotating_light",
+		"Authorization": "Bearer tk_123",
+	} {
+		if got := req.header.Get(name); got != want {
+			t.Errorf("%s %q, want %q", name, got, want)
+		}
+	}
+	if string(req.body) != event.Message {
+		t.Errorf("body %q, want the message", req.body)
+	}
+
+	// Resolutions are sent at normal priority, without a token when none is set
+	delete(cfg, "token")
+	if err := sendNtfyAlert(cfg, testAlertEvent("resolved"), "critical"); err != nil {
+		t.Fatal(err)
+	}
+	req = <-requests
+	if req.header.Get("Priority") != "default" || req.header.Get("Tags") != "white_check_mark" {
+		t.Errorf("resolved: Priority %q, Tags %q", req.header.Get("Priority"), req.header.Get("Tags"))
+	}
+	if req.header.Get("Authorization") != "" {
+		t.Errorf("Authorization sent without a token")
+	}
+
+	if err := sendNtfyAlert(map[string]interface{}{"url": srv.URL}, event, "critical"); err == nil {
+		t.Error("ntfy channel without a topic accepted")
+	}
+}
+
+func TestPostAlertFailsOnErrorStatus(t *testing.T) {
+	srv, requests := alertReceiver(t, http.StatusForbidden)
+	err := sendWebhookAlert(map[string]interface{}{"url": srv.URL}, testAlertEvent("firing"), "warning")
+	<-requests
+	if err == nil || !strings.Contains(err.Error(), "403") || !strings.Contains(err.Error(), "receiver says no") {
+		t.Errorf("err = %v, want the status and response body", err)
+	}
+}
+
+// fakeSMTPServer accepts one message without TLS or auth and returns it
+func fakeSMTPServer(t *testing.T) (host, port string, messages <-chan smtpMessage) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	out := make(chan smtpMessage, 1)
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(s string) { io.WriteString(conn, s+"\r\n") }
+
+		var msg smtpMessage
+		reply("220 fake ESMTP")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			cmd := strings.ToUpper(line)
+			switch {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				reply("250 fake")
+			case strings.HasPrefix(cmd, "MAIL FROM:"):
+				msg.from = line[len("MAIL FROM:"):]
+				reply("250 OK")
+			case strings.HasPrefix(cmd, "RCPT TO:"):
+				msg.to = append(msg.to, line[len("RCPT TO:"):])
+				reply("250 OK")
+			case cmd == "DATA":
+				reply("354 go ahead")
+				var data strings.Builder
+				for {
+					l, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if l == ".\r\n" {
+						break
+					}
+					data.WriteString(l)
+				}
+				msg.data = data.String()
+				reply("250 queued")
+			case cmd == "QUIT":
+				reply("221 bye")
+				out <- msg
+				return
+			default:
+				reply("502 not implemented")
+			}
+		}
+	}()
+
+	host, port, _ = net.SplitHostPort(ln.Addr().String())
+	return host, port, out
+}
+
+type smtpMessage struct {
+	from string
+	to   []string
+	data string
+}
+
+func TestSendSMTPAlert(t *testing.T) {
+	host, port, messages := fakeSMTPServer(t)
+	cfg := map[string]interface{}{
+		"host": host,
+		"port": port,
+		"from": "alerts@example.com",
+		"to":   "ops@example.com, oncall@example.com",
+	}
+	event := testAlertEvent("firing")
+	if err := sendSMTPAlert(cfg, event, "critical"); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := <-messages
+	if msg.from != "<alerts@example.com>" {
+		t.Errorf("MAIL FROM %s", msg.from)
+	}
+	if strings.Join(msg.to, " ") != "<ops@example.com> <oncall@example.com>" {
+		t.Errorf("RCPT TO %v, want both recipients", msg.to)
+	}
+	for _, want := range []string{
+		"From: alerts@example.com\r\n",
+		"To: ops@example.com, oncall@example.com\r\n",
+		"Subject: [FIRING] Disk full\r\n",
+		"Date: Sun, 18 Oct 2026 12:00:00 +0000\r\n",
+		"\r\n\r\n" + event.Message + "\r\n",
+	} {
+		if !strings.Contains(msg.data, want) {
+			t.Errorf("message lacks %q:\n%s", want, msg.data)
+		}
+	}
+
+	if err := sendSMTPAlert(map[string]interface{}{"host": host, "from": "a@example.com"}, event, "critical"); err == nil {
+		t.Error("smtp channel without recipients accepted")
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// useTestDB points DB at a fresh database for the length of the test
+func useTestDB(t *testing.T, models ...interface{}) {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(append([]interface{}{&SystemSetting{}}, models...)...); err != nil {
+		t.Fatal(err)
+	}
+	previous := DB
+	DB = db
+	t.Cleanup(func() {
+		DB = previous
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+}
+
+func TestParseAlertExpr(t *testing.T) {
+	tests := []struct {
+		expr    string
+		want    alertCondition
+		holdFor time.Duration
+		wantErr bool
+	}{
+		{expr: "cpu.usage > 90", want: alertCondition{Metric: "cpu.usage", Op: ">", Threshold: 90}},
+		{expr: "  load.1>=2.5  ", want: alertCondition{Metric: "load.1", Op: ">=", Threshold: 2.5}},
+		{expr: "net.rx_rate < -1", want: alertCondition{Metric: "net.rx_rate", Op: "<", Threshold: -1}},
+		{expr: "disk.used_percent > 90 for 5m", want: alertCondition{Metric: "disk.used_percent", Op: ">", Threshold: 90}, holdFor: 5 * time.Minute},
+		{expr: "service nginx != active", want: alertCondition{Service: "nginx", Op: "!=", State: "active"}},
+		{expr: "service getty@tty1.service == failed for 30s", want: alertCondition{Service: "getty@tty1.service", Op: "==", State: "failed"}, holdFor: 30 * time.Second},
+		{expr: "service my-app == active", want: alertCondition{Service: "my-app", Op: "==", State: "active"}},
+
+		{expr: "service -H == active", wantErr: true},     // Would be read as a systemctl option
+		{expr: "service --user == active", wantErr: true}, // Same
+		{expr: "cpu.usage > 1.2.3", wantErr: true},
+		{expr: "cpu.usage > .", wantErr: true},
+		{expr: "cpu.usage > high", wantErr: true},
+		{expr: "cpu.usage > 90 for soon", wantErr: true},
+		{expr: "cpu.usage > 90 for -5m", wantErr: true},
+		{expr: "cpu.usage >> 90", wantErr: true},
+		{expr: "service nginx > active", wantErr: true},
+		{expr: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		cond, holdFor, err := parseAlertExpr(tt.expr)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseAlertExpr(%q) = %+v, want an error", tt.expr, cond)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseAlertExpr(%q): %v", tt.expr, err)
+			continue
+		}
+		if *cond != tt.want || holdFor != tt.holdFor {
+			t.Errorf("parseAlertExpr(%q) = %+v for %s, want %+v for %s", tt.expr, *cond, holdFor, tt.want, tt.holdFor)
+		}
+	}
+}
+
+// A rule with a duration goes pending, fires once it has held long enough
+// and resolves when the value drops, recording both changes
+func TestEvaluateAlertsTransitions(t *testing.T) {
+	useTestDB(t, &AlertRule{}, &AlertEvent{}, &AlertSilence{}, &AlertChannel{})
+	rule := AlertRule{Name: "busy", Expr: "cpu.usage > 90", For: 60, Enabled: true}
+	DB.Create(&rule)
+	t.Cleanup(func() {
+		alertStates.Lock()
+		delete(alertStates.m, rule.ID)
+		alertStates.Unlock()
+	})
+
+	evaluate := func(cpu float64) string {
+		metricsState.Lock()
+		metricsState.latest = map[string]float64{"cpu.usage": cpu}
+		metricsState.at = time.Now()
+		metricsState.Unlock()
+		evaluateAlerts(time.Hour)
+		alertStates.Lock()
+		defer alertStates.Unlock()
+		return alertStates.m[rule.ID].State
+	}
+	backdate := func(d time.Duration) {
+		alertStates.Lock()
+		alertStates.m[rule.ID].Since = alertStates.m[rule.ID].Since.Add(-d)
+		alertStates.Unlock()
+	}
+
+	if state := evaluate(50); state != "inactive" {
+		t.Fatalf("below threshold: state %s, want inactive", state)
+	}
+	if state := evaluate(95); state != "pending" {
+		t.Fatalf("over threshold: state %s, want pending", state)
+	}
+	if state := evaluate(95); state != "pending" {
+		t.Fatalf("before the duration: state %s, want pending", state)
+	}
+	backdate(time.Minute)
+	if state := evaluate(97.5); state != "firing" {
+		t.Fatalf("after the duration: state %s, want firing", state)
+	}
+	if state := evaluate(96); state != "firing" {
+		t.Fatalf("still over threshold: state %s, want firing", state)
+	}
+	if state := evaluate(10); state != "inactive" {
+		t.Fatalf("back below threshold: state %s, want inactive", state)
+	}
+
+	var events []AlertEvent
+	DB.Where("rule_id = ?", rule.ID).Order("id asc").Find(&events)
+	if len(events) != 2 {
+		t.Fatalf("got %d events, want firing and resolved", len(events))
+	}
+	for i, want := range []struct{ state, value string }{{"firing", "97.5"}, {"resolved", "10"}} {
+		if events[i].State != want.state || events[i].Value != want.value {
+			t.Errorf("event %d: %s at %s, want %s at %s", i, events[i].State, events[i].Value, want.state, want.value)
+		}
+		if events[i].Notified != "no channels" {
+			t.Errorf("event %d: notified %q, want %q", i, events[i].Notified, "no channels")
+		}
+	}
+
+	// A condition that clears while pending never fires
+	evaluate(95)
+	evaluate(10)
+	var count int64
+	DB.Model(&AlertEvent{}).Where("rule_id = ?", rule.ID).Count(&count)
+	if count != 2 {
+		t.Errorf("pending alert that cleared recorded %d more events", count-2)
+	}
+}
@@ -76,8 +76,6 @@ export default function FileManagerPage() {
     const [uploading, setUploading] = useState(false);
     // eslint-disable-next-line @typescript-eslint/no-unused-vars
     const [uploadProgress, setUploadProgress] = useState(0);
-    const [downloading, setDownloading] = useState(false);
-    const [downloadProgress, setDownloadProgress] = useState(0);
     const [clipboard, setClipboard] = useState<{ items: any[], operation: 'copy' | 'cut' } | null>(null);
     const [contextMenu, setContextMenu] = useState<{ x: number, y: number, item: any, index: number } | null>(null);
     const [searchQuery, setSearchQuery] = useState('');
@@ -89,6 +87,7 @@ export default function FileManagerPage() {
 
     const wsRef = useRef<WebSocket | null>(null);
     const pendingRequestsRef = useRef(new Map());
+    const pendingJobsRef = useRef(new Map()); // requestId -> handler settled by job_done
     const requestIdRef = useRef(0);
 
     // WebSocket Connection
@@ -126,6 +125,17 @@ export default function FileManagerPage() {
             // Our backend now echoes requestId in data.
 
             const reqId = response.requestId;
+            // Background jobs answer with a jobId first and report job_done later
+            if (response.action === "job_progress") return;
+            if (response.action === "job_done") {
+                const handler = pendingJobsRef.current.get(reqId);
+                if (handler) {
+                    pendingJobsRef.current.delete(reqId);
+                    if (response.success) handler.resolve(response);
+                    else handler.reject(new Error(response.error || "Job failed"));
+                }
+                return;
+            }
             if (reqId !== undefined && pendingRequestsRef.current.has(reqId)) {
                 const handler = pendingRequestsRef.current.get(reqId);
                 pendingRequestsRef.current.delete(reqId);
@@ -157,13 +167,12 @@ export default function FileManagerPage() {
     }, []);
 
     // Helper to send request as Promise
-    const sendRequest = (action: string, data: any = {}) => {
+    const sendRequest = (action: string, data: any = {}, reqId: number = requestIdRef.current++) => {
         return new Promise((resolve, reject) => {
             if (!wsRef.current || wsRef.current.readyState !== WebSocket.OPEN) {
                 reject(new Error("Not connected"));
                 return;
             }
-            const reqId = requestIdRef.current++;
             pendingRequestsRef.current.set(reqId, { resolve, reject });
 
             const payload = { ...data, action, data: { ...data.data, requestId: reqId } };
@@ -183,6 +192,25 @@ export default function FileManagerPage() {
         });
     };
 
+    // Like sendRequest, but when the server starts a background job the promise
+    // settles with its job_done event instead of the immediate reply
+    const sendJobRequest = (action: string, data: any = {}) => {
+        const reqId = requestIdRef.current++;
+        return new Promise<any>((resolve, reject) => {
+            // Registered before sending: a quick job can finish before its reply arrives
+            pendingJobsRef.current.set(reqId, { resolve, reject });
+            sendRequest(action, data, reqId).then((response: any) => {
+                if (!response.jobId) {
+                    pendingJobsRef.current.delete(reqId);
+                    resolve(response);
+                }
+            }).catch((err) => {
+                pendingJobsRef.current.delete(reqId);
+                reject(err);
+            });
+        });
+    };
+
     const loadFiles = async (path = currentPath) => {
         setLoading(true);
         // Use legacy send for list since backend handles it directly without requestId usually?
@@ -216,36 +244,15 @@ export default function FileManagerPage() {
 
     // --- Handlers ---
 
-    const handleDownload = async (item: any) => {
-        setDownloading(true);
-        setDownloadProgress(20);
-        showNotification('Downloading...', 'info');
-        try {
-            const res: any = await sendRequest('read', { path: `${currentPath}/${item.name}` });
-            if (res.success && res.data) {
-                setDownloadProgress(100);
-                const binaryString = window.atob(res.data);
-                const bytes = new Uint8Array(binaryString.length);
-                for (let i = 0; i < binaryString.length; i++) {
-                    bytes[i] = binaryString.charCodeAt(i);
-                }
-                const blob = new Blob([bytes], { type: 'application/octet-stream' });
-                const url = window.URL.createObjectURL(blob);
-                const a = document.createElement('a');
-                a.href = url;
-                a.download = item.name;
-                document.body.appendChild(a);
-                a.click();
-                document.body.removeChild(a);
-                window.URL.revokeObjectURL(url);
-                showNotification('Download complete', 'success');
-            }
-        } catch (e: any) {
-            showNotification('Download failed: ' + e.message, 'error');
-        } finally {
-            setDownloading(false);
-            setDownloadProgress(0);
-        }
+    const handleDownload = (item: any) => {
+        // Streamed over HTTP so large files never go through the WebSocket
+        const a = document.createElement('a');
+        a.href = `/api/files/download?path=${encodeURIComponent(`${currentPath}/${item.name}`)}`;
+        a.download = item.name;
+        document.body.appendChild(a);
+        a.click();
+        document.body.removeChild(a);
+        showNotification('Download started', 'info');
     };
 
     const handleDelete = async () => {
@@ -263,6 +270,15 @@ export default function FileManagerPage() {
         if (item.isDir) return;
         try {
             const res: any = await sendRequest('read', { path: `${currentPath}/${item.name}` });
+            if (res.binary) {
+                showNotification('Binary files cannot be edited', 'error');
+                return;
+            }
+            // The editor saves UTF-8, which would silently re-encode anything else
+            if (res.encoding && res.encoding !== 'utf-8') {
+                showNotification(`${res.encoding} files cannot be edited`, 'error');
+                return;
+            }
             if (res.success && res.data) {
                 const content = decodeURIComponent(escape(window.atob(res.data)));
                 setEditingFile(item);
@@ -372,40 +388,36 @@ export default function FileManagerPage() {
     }
 
     const handleCopy = () => {
-        const itemsToCopy = selectedItems.map(i => items[i]);
+        const itemsToCopy = selectedItems.map(i => ({ ...items[i], _fullPath: `${currentPath}/${items[i].name}` }));
         setClipboard({ items: itemsToCopy, operation: 'copy' });
         showNotification('Copied to clipboard', 'info');
     }
 
     const handleCut = () => {
-        const itemsToCut = selectedItems.map(i => items[i]);
+        const itemsToCut = selectedItems.map(i => ({ ...items[i], _fullPath: `${currentPath}/${items[i].name}` }));
         setClipboard({ items: itemsToCut, operation: 'cut' });
         showNotification('Cut to clipboard', 'info');
     }
 
     const handlePaste = async () => {
         if (!clipboard) return;
+        const action = clipboard.operation === 'copy' ? 'copy' : 'move';
+        const failures: string[] = [];
         for (const item of clipboard.items) {
-            const oldPath = `${currentPath === "/" ? "" : currentPath}/${item.name}`; // This logic is flawed if cross-dir copy. Should use item's original path. 
-            // But our item list doesn't have full path? 
-            // Wait, backend `list` usually names, but if we navigate away... clipboard items need source path.
-            // Let's assume user copies from current dir and pastes elsewhere, we need to store `path` in item or clipboard.
-            // Since we don't store path in item state, let's just hack it: "We assume copy checks clipboard logic locally".
-            // Actually, let's just use `copy` action with `newPath`.
-
-            // Re-implement correctly: stash path in clipboard
             const srcPath = item._fullPath || `${currentPath}/${item.name}`;
             const destPath = `${currentPath}/${item.name}`;
-
-            if (clipboard.operation === 'copy') {
-                await sendRequest('copy', { path: srcPath, newPath: destPath }).catch(console.error);
-            } else {
-                await sendRequest('rename', { path: srcPath, newPath: destPath }).catch(console.error);
-            }
+            if (action === 'move' && srcPath === destPath) continue; // Cut and pasted in place
+            // Copies and moves run as background jobs; an existing name gets a numbered copy
+            await sendJobRequest(action, { path: srcPath, newPath: destPath, data: { conflict: 'rename' } })
+                .catch((err) => failures.push(`${item.name}: ${err.message}`));
         }
         setClipboard(null);
         loadFiles(currentPath);
-        showNotification('Paste complete', 'success');
+        if (failures.length > 0) {
+            showNotification(`Paste failed for ${failures.join(', ')}`, 'error');
+        } else {
+            showNotification('Paste complete', 'success');
+        }
     }
 
     // File Upload
@@ -568,8 +580,8 @@ export default function FileManagerPage() {
                                             {item.isDir && <div className="absolute -bottom-1 -right-1 w-2.5 h-2.5 bg-emerald-500 rounded-full border-2 border-white dark:border-neutral-900" />}
                                         </div>
                                         <div className="w-full overflow-hidden">
-                                            <div className="text-xs font-medium text-slate-700 dark:text-slate-300 truncate">{item.name}</div>
-                                            <div className="text-[10px] text-slate-500 mt-0.5">{item.isDir ? 'Folder' : formatBytes(item.size)}</div>
+                                            <div className="text-xs font-medium text-slate-700 dark:text-slate-300 truncate" title={item.isLink ? `${item.name} → ${item.linkTarget}` : item.name}>{item.name}</div>
+                                            <div className={`text-[10px] mt-0.5 ${item.brokenLink ? 'text-red-500' : 'text-slate-500'}`}>{item.brokenLink ? 'Broken link' : item.isDir ? (item.isLink ? 'Folder link' : 'Folder') : formatBytes(item.size)}</div>
                                         </div>
                                     </div>
                                 ))}
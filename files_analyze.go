@@ -0,0 +1,302 @@
+package main
+
+import (
+	"container/heap"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ==================== DISK USAGE ANALYZER ====================
+// The "analyze" action walks a tree like ncdu: it stays on one filesystem by
+// default, streams the biggest top-level entries while scanning and keeps the
+// finished tree cached so navigating into subdirectories is instant. Any file
+// manager change under a cached tree drops it from the cache.
+
+const (
+	defaultAnalyzeCacheMinutes = 10 // Override with ANALYZE_CACHE_MINUTES
+	defaultAnalyzeDepth        = 2
+	defaultAnalyzeTop          = 20
+	analyzeKeepFiles           = 1000 // Largest files kept per scan, so subtrees still have a useful list
+	analyzeMaxChildren         = 100  // Per node in responses
+	analyzeProgressInterval    = time.Second
+)
+
+type duNode struct {
+	Name     string
+	Path     string
+	Size     int64 // Disk usage (allocated blocks)
+	Apparent int64 // Sum of file sizes
+	Own      int64 // Disk usage of files directly inside
+	Files    int64
+	Dirs     int64
+
+	parent   *duNode
+	children []*duNode
+}
+
+type duFile struct {
+	Path     string `json:"path"`
+	Size     int64  `json:"size"`
+	Apparent int64  `json:"apparent"`
+}
+
+type duResult struct {
+	Root          *duNode
+	nodes         map[string]*duNode
+	Files         []duFile // Largest files, biggest first
+	CrossMounts   bool
+	SkippedMounts []string
+	Errors        int64
+	ScannedAt     time.Time
+}
+
+var duCache = struct {
+	sync.Mutex
+	m map[string]*duResult // Keyed by root and crossMounts
+}{m: make(map[string]*duResult)}
+
+func duCacheKey(root string, crossMounts bool) string {
+	if crossMounts {
+		return root + "\x00all"
+	}
+	return root
+}
+
+// cachedAnalysis finds a fresh cached scan covering path
+func cachedAnalysis(path string, crossMounts bool) (*duResult, *duNode) {
+	ttl := time.Duration(getSettingInt("ANALYZE_CACHE_MINUTES", defaultAnalyzeCacheMinutes)) * time.Minute
+	duCache.Lock()
+	defer duCache.Unlock()
+	for key, res := range duCache.m {
+		if time.Since(res.ScannedAt) > ttl {
+			delete(duCache.m, key)
+			continue
+		}
+		if res.CrossMounts != crossMounts {
+			continue
+		}
+		if node := res.nodes[path]; node != nil {
+			return res, node
+		}
+	}
+	return nil, nil
+}
+
+// invalidateAnalysis drops cached scans that contain or are inside any of paths
+func invalidateAnalysis(paths ...string) {
+	duCache.Lock()
+	defer duCache.Unlock()
+	for key, res := range duCache.m {
+		for _, p := range paths {
+			if p != "" && (pathWithin(p, res.Root.Path) || pathWithin(res.Root.Path, p)) {
+				delete(duCache.m, key)
+				break
+			}
+		}
+	}
+}
+
+// pathWithin reports whether path is root or below it
+func pathWithin(path, root string) bool {
+	return path == root || root == "/" || strings.HasPrefix(path, root+"/")
+}
+
+// analyzeTree walks root, calling progress with the partial tree every second
+func analyzeTree(job *fileJob, root string, crossMounts bool, progress func(*duNode)) (*duResult, error) {
+	var rootStat syscall.Stat_t
+	if err := syscall.Stat(root, &rootStat); err != nil {
+		return nil, err
+	}
+
+	res := &duResult{
+		Root:        &duNode{Name: filepath.Base(root), Path: root, Size: rootStat.Blocks * 512},
+		nodes:       make(map[string]*duNode),
+		CrossMounts: crossMounts,
+	}
+	res.nodes[root] = res.Root
+	seenLinks := make(map[[2]uint64]bool) // Hard links are counted once
+	lastProgress := time.Now()
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if ctxErr := job.ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if err != nil {
+			res.Errors++
+			if d != nil && d.IsDir() && path != root {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		atomic.AddInt64(&job.Done, 1)
+		if time.Since(lastProgress) > analyzeProgressInterval {
+			lastProgress = time.Now()
+			progress(res.Root)
+		}
+		if path == root {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			res.Errors++
+			return nil
+		}
+		st, _ := info.Sys().(*syscall.Stat_t)
+		parent := res.nodes[filepath.Dir(path)]
+
+		if d.IsDir() {
+			if searchSkipDirs[path] || (st != nil && st.Dev != rootStat.Dev && !crossMounts) {
+				res.SkippedMounts = append(res.SkippedMounts, path)
+				return fs.SkipDir
+			}
+			node := &duNode{Name: d.Name(), Path: path, parent: parent}
+			parent.children = append(parent.children, node)
+			res.nodes[path] = node
+			for n := parent; n != nil; n = n.parent {
+				n.Dirs++
+			}
+			// A directory's own blocks count towards it and its parents
+			if st != nil {
+				for n := node; n != nil; n = n.parent {
+					n.Size += st.Blocks * 512
+				}
+			}
+			return nil
+		}
+
+		usage := info.Size()
+		if st != nil {
+			if st.Nlink > 1 {
+				key := [2]uint64{uint64(st.Dev), st.Ino}
+				if seenLinks[key] {
+					return nil
+				}
+				seenLinks[key] = true
+			}
+			usage = st.Blocks * 512
+		}
+		parent.Own += usage
+		for n := parent; n != nil; n = n.parent {
+			n.Size += usage
+			n.Apparent += info.Size()
+			n.Files++
+		}
+		res.keepFile(duFile{Path: path, Size: usage, Apparent: info.Size()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(res.Files, func(i, j int) bool { return res.Files[i].Size > res.Files[j].Size })
+	res.ScannedAt = time.Now()
+	return res, nil
+}
+
+// keepFile tracks the largest files seen in a min-heap bounded by analyzeKeepFiles
+func (res *duResult) keepFile(f duFile) {
+	h := (*duFileHeap)(&res.Files)
+	if h.Len() < analyzeKeepFiles {
+		heap.Push(h, f)
+	} else if f.Size > res.Files[0].Size {
+		res.Files[0] = f
+		heap.Fix(h, 0)
+	}
+}
+
+type duFileHeap []duFile
+
+func (h duFileHeap) Len() int            { return len(h) }
+func (h duFileHeap) Less(i, j int) bool  { return h[i].Size < h[j].Size }
+func (h duFileHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *duFileHeap) Push(x interface{}) { *h = append(*h, x.(duFile)) }
+func (h *duFileHeap) Pop() interface{} {
+	old := *h
+	f := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return f
+}
+
+// nodeJSON renders node and its children down to depth, biggest first
+func nodeJSON(node *duNode, depth int) map[string]interface{} {
+	out := map[string]interface{}{
+		"name":     node.Name,
+		"path":     node.Path,
+		"size":     node.Size,
+		"apparent": node.Apparent,
+		"files":    node.Files,
+		"dirs":     node.Dirs,
+	}
+	if depth > 0 && len(node.children) > 0 {
+		children := append([]*duNode(nil), node.children...)
+		sort.Slice(children, func(i, j int) bool { return children[i].Size > children[j].Size })
+		if len(children) > analyzeMaxChildren {
+			children = children[:analyzeMaxChildren]
+		}
+		list := make([]map[string]interface{}, len(children))
+		for i, child := range children {
+			list[i] = nodeJSON(child, depth-1)
+		}
+		out["children"] = list
+	}
+	return out
+}
+
+// analysisJSON builds the response for node out of a finished scan
+func analysisJSON(res *duResult, node *duNode, depth, top int, cached bool) map[string]interface{} {
+	files := []duFile{}
+	for _, f := range res.Files {
+		if len(files) >= top {
+			break
+		}
+		if pathWithin(f.Path, node.Path) {
+			files = append(files, f)
+		}
+	}
+
+	// Largest directories by the files directly inside them, since cumulative
+	// sizes would just list the ancestors of the biggest one
+	var dirs []*duNode
+	var collect func(n *duNode)
+	collect = func(n *duNode) {
+		dirs = append(dirs, n)
+		for _, child := range n.children {
+			collect(child)
+		}
+	}
+	collect(node)
+	sort.Slice(dirs, func(i, j int) bool { return dirs[i].Own > dirs[j].Own })
+	if len(dirs) > top {
+		dirs = dirs[:top]
+	}
+	largestDirs := make([]map[string]interface{}, 0, len(dirs))
+	for _, d := range dirs {
+		largestDirs = append(largestDirs, map[string]interface{}{"path": d.Path, "own": d.Own, "size": d.Size, "files": d.Files})
+	}
+
+	skipped := []string{}
+	for _, m := range res.SkippedMounts {
+		if pathWithin(m, node.Path) {
+			skipped = append(skipped, m)
+		}
+	}
+
+	return map[string]interface{}{
+		"path":          node.Path,
+		"tree":          nodeJSON(node, depth),
+		"largestFiles":  files,
+		"largestDirs":   largestDirs,
+		"skippedMounts": skipped,
+		"crossMounts":   res.CrossMounts,
+		"errors":        res.Errors,
+		"scannedAt":     res.ScannedAt,
+		"cached":        cached,
+	}
+}
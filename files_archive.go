@@ -0,0 +1,585 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/klauspost/compress/zstd"
+)
+
+// ==================== ARCHIVES ====================
+// zip, tar, tar.gz and tar.zst creation and extraction, used by the
+// compress/extract file actions and the folder download endpoint.
+
+var archiveFormats = map[string]string{
+	".zip":     "zip",
+	".tar":     "tar",
+	".tar.gz":  "tar.gz",
+	".tgz":     "tar.gz",
+	".tar.zst": "tar.zst",
+	".tzst":    "tar.zst",
+}
+
+var errUnsafeArchivePath = errors.New("archive entry escapes destination")
+
+// archiveFormat returns the explicit format if valid, otherwise infers it from the file name
+func archiveFormat(explicit, name string) (string, error) {
+	if explicit != "" {
+		for _, f := range archiveFormats {
+			if f == explicit {
+				return f, nil
+			}
+		}
+		return "", fmt.Errorf("unsupported archive format %q", explicit)
+	}
+	lower := strings.ToLower(name)
+	for _, ext := range []string{".tar.gz", ".tar.zst", ".tgz", ".tzst", ".zip", ".tar"} {
+		if strings.HasSuffix(lower, ext) {
+			return archiveFormats[ext], nil
+		}
+	}
+	return "", fmt.Errorf("cannot infer archive format from %q", filepath.Base(name))
+}
+
+// treeSize sums the regular file sizes under src
+func treeSize(src string) int64 {
+	var total int64
+	filepath.WalkDir(src, func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				total += info.Size()
+			}
+		}
+		return nil
+	})
+	return total
+}
+
+// zipUncompressedSize sums entry sizes for extraction progress
+func zipUncompressedSize(path string) int64 {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return 0
+	}
+	defer zr.Close()
+	var total int64
+	for _, f := range zr.File {
+		total += int64(f.UncompressedSize64)
+	}
+	return total
+}
+
+// writeArchive streams src (file or directory) into w. Entries are named
+// relative to src's parent so the archive contains a top-level folder.
+// Files matching one of exclude (the archive being written) are left out.
+func writeArchive(ctx context.Context, w io.Writer, src, format string, progress func(int64), exclude ...os.FileInfo) error {
+	base := filepath.Dir(src)
+	excluded := func(info os.FileInfo) bool {
+		for _, ex := range exclude {
+			if os.SameFile(info, ex) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if format == "zip" {
+		zw := zip.NewWriter(w)
+		err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if excluded(info) {
+				return nil
+			}
+			rel, _ := filepath.Rel(base, path)
+			header, err := zip.FileInfoHeader(info)
+			if err != nil {
+				return err
+			}
+			header.Name = filepath.ToSlash(rel)
+			if info.IsDir() {
+				header.Name += "/"
+			} else {
+				header.Method = zip.Deflate
+			}
+			entry, err := zw.CreateHeader(header)
+			if err != nil {
+				return err
+			}
+			switch {
+			case info.Mode()&os.ModeSymlink != 0:
+				target, err := os.Readlink(path)
+				if err != nil {
+					return err
+				}
+				_, err = io.WriteString(entry, target)
+				return err
+			case info.Mode().IsRegular():
+				return copyFileInto(ctx, entry, path, progress)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return zw.Close()
+	}
+
+	var compressor io.WriteCloser
+	switch format {
+	case "tar.gz":
+		compressor = gzip.NewWriter(w)
+	case "tar.zst":
+		zw, err := zstd.NewWriter(w)
+		if err != nil {
+			return err
+		}
+		compressor = zw
+	}
+	tarTarget := w
+	if compressor != nil {
+		tarTarget = compressor
+	}
+
+	tw := tar.NewWriter(tarTarget)
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if excluded(info) {
+			return nil
+		}
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(base, path)
+		header.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			return copyFileInto(ctx, tw, path, progress)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if compressor != nil {
+		return compressor.Close()
+	}
+	return nil
+}
+
+func copyFileInto(ctx context.Context, w io.Writer, path string, progress func(int64)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	buf := make([]byte, 256*1024)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, readErr := f.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+			if progress != nil {
+				progress(int64(n))
+			}
+		}
+		if readErr == io.EOF {
+			return nil
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+}
+
+// createArchive writes the archive to a temp file beside dest and renames it into place
+func createArchive(ctx context.Context, src, dest, format string, progress func(int64)) error {
+	tmp, err := os.CreateTemp(filepath.Dir(resolveTarget(dest)), "."+filepath.Base(dest)+".partial-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	// dest may be inside src: leave out the growing temp file and any
+	// previous archive about to be replaced
+	var exclude []os.FileInfo
+	for _, path := range []string{tmp.Name(), dest} {
+		if info, err := os.Stat(path); err == nil {
+			exclude = append(exclude, info)
+		}
+	}
+	bw := bufio.NewWriterSize(tmp, 256*1024)
+	if err := writeArchive(ctx, bw, src, format, progress, exclude...); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return placeFile(tmp.Name(), dest)
+}
+
+// safeJoin resolves an archive entry name inside dest, rejecting absolute
+// paths and ".." components that would escape it (zip-slip).
+func safeJoin(dest, name string) (string, error) {
+	name = filepath.FromSlash(name)
+	if filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return "", errUnsafeArchivePath
+	}
+	target := filepath.Join(dest, name)
+	if target != dest && !strings.HasPrefix(target, dest+string(os.PathSeparator)) {
+		return "", errUnsafeArchivePath
+	}
+	return target, nil
+}
+
+// ensureParentInside creates the parent directories of target and makes sure
+// none of them is a symlink leading outside dest (planted by an earlier entry).
+// Only existing components can be symlinks, so the check runs before MkdirAll.
+func ensureParentInside(dest, target string) error {
+	parent := filepath.Dir(target)
+	existing := parent
+	for {
+		if _, err := os.Lstat(existing); err == nil || existing == dest {
+			break
+		}
+		existing = filepath.Dir(existing)
+	}
+	resolved, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return err
+	}
+	if resolved != dest && !strings.HasPrefix(resolved, dest+string(os.PathSeparator)) {
+		return errUnsafeArchivePath
+	}
+	return os.MkdirAll(parent, 0755)
+}
+
+// checkLinkTarget rejects links whose target would resolve outside dest.
+// The target is joined to the link's real parent, since earlier entries may
+// have made that parent a symlink, and ".." may only lead the target: after a
+// component that can itself become a symlink, the text no longer says where
+// ".." goes. linkPath's parent must already exist.
+func checkLinkTarget(dest, linkPath, target string) error {
+	target = filepath.FromSlash(target)
+	if filepath.IsAbs(target) || filepath.VolumeName(target) != "" {
+		return errUnsafeArchivePath
+	}
+	parent, err := filepath.EvalSymlinks(filepath.Dir(linkPath))
+	if err != nil {
+		return err
+	}
+	descending := false
+	for _, part := range strings.Split(target, string(os.PathSeparator)) {
+		switch part {
+		case "", ".":
+		case "..":
+			if descending {
+				return errUnsafeArchivePath
+			}
+			parent = filepath.Dir(parent)
+		default:
+			descending = true
+		}
+	}
+	if parent != dest && !strings.HasPrefix(parent, dest+string(os.PathSeparator)) {
+		return errUnsafeArchivePath
+	}
+	return nil
+}
+
+// writeExtractedFile writes one regular file as a new inode, never through an existing link
+func writeExtractedFile(ctx context.Context, dest, target string, r io.Reader, mode os.FileMode) error {
+	if err := ensureParentInside(dest, target); err != nil {
+		return err
+	}
+	// Replace rather than truncate whatever is there: a symlink or a hardlink
+	// planted by an earlier entry would have the data written through it
+	if _, err := os.Lstat(target); err == nil {
+		if err := os.Remove(target); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode.Perm())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	buf := make([]byte, 256*1024)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, readErr := r.Read(buf)
+		if n > 0 {
+			if _, err := f.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if readErr == io.EOF {
+			return nil
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+}
+
+func createExtractedSymlink(dest, target, linkname string) error {
+	if err := ensureParentInside(dest, target); err != nil {
+		return err
+	}
+	if err := checkLinkTarget(dest, target, linkname); err != nil {
+		return err
+	}
+	os.Remove(target)
+	return os.Symlink(linkname, target)
+}
+
+// extractArchive unpacks src into dest. progress receives compressed bytes
+// read for tar formats and uncompressed bytes written for zip.
+func extractArchive(ctx context.Context, src, dest, format string, progress func(int64)) error {
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+	dest, err := filepath.EvalSymlinks(dest)
+	if err != nil {
+		return err
+	}
+
+	if format == "zip" {
+		zr, err := zip.OpenReader(src)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+
+		for _, file := range zr.File {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			target, err := safeJoin(dest, file.Name)
+			if err != nil {
+				return fmt.Errorf("%s: %w", file.Name, err)
+			}
+			mode := file.Mode()
+			switch {
+			case mode.IsDir():
+				if err := ensureParentInside(dest, target); err != nil {
+					return err
+				}
+				if err := os.MkdirAll(target, 0755); err != nil {
+					return err
+				}
+			case mode&os.ModeSymlink != 0:
+				rc, err := file.Open()
+				if err != nil {
+					return err
+				}
+				linkname, err := io.ReadAll(io.LimitReader(rc, 4096))
+				rc.Close()
+				if err != nil {
+					return err
+				}
+				if err := createExtractedSymlink(dest, target, string(linkname)); err != nil {
+					return fmt.Errorf("%s: %w", file.Name, err)
+				}
+			default:
+				rc, err := file.Open()
+				if err != nil {
+					return err
+				}
+				err = writeExtractedFile(ctx, dest, target, rc, mode)
+				rc.Close()
+				if err != nil {
+					return fmt.Errorf("%s: %w", file.Name, err)
+				}
+				if progress != nil {
+					progress(int64(file.UncompressedSize64))
+				}
+			}
+		}
+		return nil
+	}
+
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if progress != nil {
+		r = &countingReader{r: f, progress: progress}
+	}
+	switch format {
+	case "tar.gz":
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	case "tar.zst":
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		target, err := safeJoin(dest, header.Name)
+		if err != nil {
+			return fmt.Errorf("%s: %w", header.Name, err)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := ensureParentInside(dest, target); err != nil {
+				return err
+			}
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := writeExtractedFile(ctx, dest, target, tr, os.FileMode(header.Mode)); err != nil {
+				return fmt.Errorf("%s: %w", header.Name, err)
+			}
+		case tar.TypeSymlink:
+			if err := createExtractedSymlink(dest, target, header.Linkname); err != nil {
+				return fmt.Errorf("%s: %w", header.Name, err)
+			}
+		case tar.TypeLink:
+			linkTarget, err := safeJoin(dest, header.Linkname)
+			if err != nil {
+				return fmt.Errorf("%s: %w", header.Name, err)
+			}
+			// The source may sit behind a symlink an earlier entry created
+			if linkTarget, err = filepath.EvalSymlinks(linkTarget); err != nil {
+				return fmt.Errorf("%s: %w", header.Name, err)
+			}
+			if !strings.HasPrefix(linkTarget, dest+string(os.PathSeparator)) {
+				return fmt.Errorf("%s: %w", header.Name, errUnsafeArchivePath)
+			}
+			if err := ensureParentInside(dest, target); err != nil {
+				return err
+			}
+			os.Remove(target)
+			if err := os.Link(linkTarget, target); err != nil {
+				return err
+			}
+		default:
+			// Devices, FIFOs etc. are skipped
+		}
+	}
+}
+
+type countingReader struct {
+	r        io.Reader
+	progress func(int64)
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.progress(int64(n))
+	return n, err
+}
+
+// DownloadArchive streams a directory as an archive without staging it on disk.
+// GET /api/files/archive?path=/var/www&format=zip|tar|tar.gz|tar.zst
+func DownloadArchive(c *fiber.Ctx) error {
+	claims := c.Locals("user").(jwt.MapClaims)
+	userIdFloat, _ := claims["iss"].(float64)
+
+	if c.Query("path") == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "path required"})
+	}
+	src := filepath.Clean(c.Query("path"))
+	if _, err := os.Stat(src); err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": "Path not found"})
+	}
+	format, err := archiveFormat(c.Query("format", "zip"), "")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": err.Error()})
+	}
+
+	name := filepath.Base(src)
+	if name == string(os.PathSeparator) {
+		name = "root"
+	}
+	c.Set("Content-Type", "application/octet-stream")
+	c.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+"."+format))
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		// The client disconnecting surfaces as a write error, which stops the walk
+		var sent int64
+		err := writeArchive(context.Background(), w, src, format, func(n int64) { sent += n })
+		if flushErr := w.Flush(); err == nil {
+			err = flushErr
+		}
+		auditFile(uint(userIdFloat), "FILE_DOWNLOAD", src, "", sent, "Downloaded as "+format+" archive", err)
+	})
+	return nil
+}
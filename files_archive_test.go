@@ -0,0 +1,122 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A symlink chain that looks inside dest as text but points outside it on
+// disk, then a hardlink through it and a file written over the hardlink.
+func TestExtractArchiveLinkEscape(t *testing.T) {
+	root := t.TempDir()
+	dest := filepath.Join(root, "x", "y", "dest") // "../../.." from dest is root
+	outside := filepath.Join(root, "outside")
+	if err := os.MkdirAll(outside, 0755); err != nil {
+		t.Fatal(err)
+	}
+	secret := filepath.Join(outside, "secret")
+	if err := os.WriteFile(secret, []byte("original"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	src := filepath.Join(root, "evil.tar")
+	f, err := os.Create(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(f)
+	entries := []tar.Header{
+		{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "."},
+		{Name: "a/a/a/b", Typeflag: tar.TypeSymlink, Linkname: "../../.."},
+		{Name: "h", Typeflag: tar.TypeLink, Linkname: "b/outside/secret"},
+		{Name: "h", Typeflag: tar.TypeReg, Mode: 0644, Size: 5},
+	}
+	for _, h := range entries {
+		h := h
+		if err := tw.WriteHeader(&h); err != nil {
+			t.Fatal(err)
+		}
+		if h.Typeflag == tar.TypeReg {
+			tw.Write([]byte("pwned"))
+		}
+	}
+	tw.Close()
+	f.Close()
+
+	if err := extractArchive(context.Background(), src, dest, "tar", nil); err == nil {
+		t.Error("extractArchive accepted an archive escaping its destination")
+	}
+	data, err := os.ReadFile(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "original" {
+		t.Fatalf("file outside the destination was overwritten: %q", data)
+	}
+}
+
+// Overwriting a file that an earlier entry hardlinked must not write through the link
+func TestExtractArchiveReplacesHardlink(t *testing.T) {
+	root := t.TempDir()
+	dest := filepath.Join(root, "dest")
+
+	src := filepath.Join(root, "links.tar")
+	f, err := os.Create(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(f)
+	tw.WriteHeader(&tar.Header{Name: "orig", Typeflag: tar.TypeReg, Mode: 0644, Size: 4})
+	tw.Write([]byte("keep"))
+	tw.WriteHeader(&tar.Header{Name: "copy", Typeflag: tar.TypeLink, Linkname: "orig"})
+	tw.WriteHeader(&tar.Header{Name: "copy", Typeflag: tar.TypeReg, Mode: 0644, Size: 3})
+	tw.Write([]byte("new"))
+	tw.Close()
+	f.Close()
+
+	if err := extractArchive(context.Background(), src, dest, "tar", nil); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dest, "orig")); string(data) != "keep" {
+		t.Fatalf("orig = %q, want %q", data, "keep")
+	}
+	if data, _ := os.ReadFile(filepath.Join(dest, "copy")); string(data) != "new" {
+		t.Fatalf("copy = %q, want %q", data, "new")
+	}
+}
+
+// Compressing a folder into itself must not pick up the archive being written
+func TestCreateArchiveInsideSource(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "dir")
+	if err := os.MkdirAll(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(src, "x.tar")
+	for i := 0; i < 2; i++ { // The second run replaces the first archive
+		if err := createArchive(context.Background(), src, dest, "tar", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := os.Open(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	for {
+		h, err := tr.Next()
+		if err != nil {
+			break
+		}
+		if h.Name != "dir/" && h.Name != "dir/file" {
+			t.Errorf("unexpected entry %q", h.Name)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// ==================== ATOMIC WRITES ====================
+// Saves go to a temp file in the target's directory, are fsynced, optionally
+// validated, then renamed over the target so a crash never leaves a half
+// written file. The replaced file's mode, owner and xattrs are carried over.
+
+const validateTimeout = 30 * time.Second
+
+// validationError carries the output of a failed validation hook
+type validationError struct {
+	Validator string
+	Output    string
+	Err       error
+}
+
+func (e *validationError) Error() string {
+	return fmt.Sprintf("validation failed (%s): %v", e.Validator, e.Err)
+}
+
+// fileValidator checks a candidate file before it replaces target
+type fileValidator struct {
+	Name string
+	Run  func(ctx context.Context, candidate, target string) (string, error)
+}
+
+// atomicWriteFile replaces path with data. Symlinks are resolved so the link
+// itself is kept. When the temp file can't take over the original owner
+// (not running as root) the file is rewritten in place instead.
+func atomicWriteFile(path string, data []byte, validators ...fileValidator) error {
+	target := resolveTarget(path)
+
+	info, err := os.Stat(target)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if info != nil && info.IsDir() {
+		return fmt.Errorf("%s is a directory", path)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(target), "."+filepath.Base(target)+".tmp-*")
+	if err != nil {
+		if info != nil && errors.Is(err, os.ErrPermission) {
+			// Directory not writable but the file is: fall back to an in-place write
+			return writeInPlace(target, data, validators)
+		}
+		return err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err := tmp.Write(data); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if info != nil {
+		if err := copyFileAttrs(info, target, tmp.Name()); err != nil {
+			if errors.Is(err, syscall.EPERM) {
+				os.Remove(tmp.Name())
+				committed = true
+				return writeInPlace(target, data, validators)
+			}
+			return err
+		}
+	} else if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+
+	if err := runValidators(validators, tmp.Name(), target); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), target); err != nil {
+		return err
+	}
+	committed = true
+	syncDir(filepath.Dir(target))
+	return nil
+}
+
+// resolveTarget follows symlinks at path so a replacement lands on the file
+// the link points to instead of replacing the link itself
+func resolveTarget(path string) string {
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		return resolved
+	}
+	return path
+}
+
+// writeInPlace truncates and rewrites target, keeping its inode (and so its
+// owner, mode and xattrs). Validators still see the content in a temp file.
+func writeInPlace(target string, data []byte, validators []fileValidator) error {
+	if len(validators) > 0 {
+		tmp, err := os.CreateTemp("", "."+filepath.Base(target)+".validate-*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		_, err = tmp.Write(data)
+		tmp.Close()
+		if err != nil {
+			return err
+		}
+		if err := runValidators(validators, tmp.Name(), target); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// copyFileAttrs applies the mode, owner and extended attributes of the file
+// described by info (at src) to dst
+func copyFileAttrs(info os.FileInfo, src, dst string) error {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		if err := os.Lchown(dst, int(st.Uid), int(st.Gid)); err != nil {
+			// Only a problem when ownership would actually change
+			if dstInfo, statErr := os.Lstat(dst); statErr != nil || !sameOwner(dstInfo, st) {
+				return err
+			}
+		}
+	}
+	// chmod after chown, which clears setuid/setgid bits
+	if err := os.Chmod(dst, info.Mode()&(os.ModePerm|specialModeBits)); err != nil {
+		return err
+	}
+	for _, name := range listXattrs(src) {
+		buf := make([]byte, 64*1024)
+		n, err := unix.Lgetxattr(src, name, buf)
+		if err != nil {
+			continue
+		}
+		if err := unix.Lsetxattr(dst, name, buf[:n], 0); err != nil {
+			log.Printf("files: could not copy xattr %s to %s: %v", name, dst, err)
+		}
+	}
+	return nil
+}
+
+func sameOwner(info os.FileInfo, st *syscall.Stat_t) bool {
+	dst, ok := info.Sys().(*syscall.Stat_t)
+	return ok && dst.Uid == st.Uid && dst.Gid == st.Gid
+}
+
+// syncDir fsyncs a directory so a rename into it is durable
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+func runValidators(validators []fileValidator, candidate, target string) error {
+	for _, v := range validators {
+		ctx, cancel := context.WithTimeout(context.Background(), validateTimeout)
+		output, err := v.Run(ctx, candidate, target)
+		cancel()
+		if err != nil {
+			return &validationError{Validator: v.Name, Output: output, Err: err}
+		}
+	}
+	return nil
+}
+
+// commandValidator runs a shell command against the candidate file. "{}" in
+// the command is replaced by the candidate path, which is also exported as
+// $FILE ($TARGET is the path being replaced).
+func commandValidator(name, command string) fileValidator {
+	return fileValidator{
+		Name: name,
+		Run: func(ctx context.Context, candidate, target string) (string, error) {
+			cmd := exec.CommandContext(ctx, "sh", "-c", strings.ReplaceAll(command, "{}", shellQuote(candidate)))
+			cmd.Env = append(os.Environ(), "FILE="+candidate, "TARGET="+target)
+			var out bytes.Buffer
+			cmd.Stdout = &out
+			cmd.Stderr = &out
+			err := cmd.Run()
+			if ctx.Err() != nil {
+				err = fmt.Errorf("timed out after %s", validateTimeout)
+			}
+			return strings.TrimSpace(out.String()), err
+		},
+	}
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ==================== FILE AUDIT ====================
+// Every file manager mutation goes through auditFile so the activity log
+// records who did what, on which paths, how many bytes and whether it worked.
+
+// Reads of these paths are logged as FILE_READ; override with AUDIT_READ_PATHS
+// (comma-separated globs, empty to disable)
+const defaultAuditReadPaths = "/etc/shadow,/etc/gshadow,/etc/sudoers,/etc/sudoers.d/**,/etc/ssh/**,/root/.ssh/**,/home/*/.ssh/**"
+
+// auditFile records a file operation. On failure the error is appended to
+// details and the entry is marked as such. The created entry is returned so
+// callers can link snapshots to it.
+func auditFile(userID uint, action, target, destination string, bytes int64, details string, err error) ActivityLog {
+	entry := ActivityLog{
+		UserID:      userID,
+		Action:      action,
+		Target:      target,
+		Destination: destination,
+		Bytes:       bytes,
+		Details:     details,
+		Result:      "success",
+		CreatedAt:   time.Now(),
+	}
+	if err != nil {
+		entry.Result = "failure"
+		if entry.Details != "" {
+			entry.Details += ": "
+		}
+		entry.Details += err.Error()
+	}
+	DB.Create(&entry)
+	if action != "FILE_READ" {
+		invalidateAnalysis(target, destination)
+	}
+	return entry
+}
+
+var auditReadCache struct {
+	sync.Mutex
+	spec     string
+	patterns []*regexp.Regexp
+}
+
+// auditRead logs a FILE_READ when path, or the file it resolves to, matches
+// one of the sensitive path globs
+func auditRead(userID uint, path string, bytes int64, err error) {
+	spec := getSetting("AUDIT_READ_PATHS", defaultAuditReadPaths)
+
+	auditReadCache.Lock()
+	if spec != auditReadCache.spec || auditReadCache.patterns == nil {
+		auditReadCache.spec = spec
+		auditReadCache.patterns = []*regexp.Regexp{}
+		for _, glob := range strings.Split(spec, ",") {
+			if glob = strings.TrimSpace(glob); glob == "" {
+				continue
+			}
+			if re, err := regexp.Compile("^" + globToRegexp(glob) + "$"); err == nil {
+				auditReadCache.patterns = append(auditReadCache.patterns, re)
+			}
+		}
+	}
+	patterns := auditReadCache.patterns
+	auditReadCache.Unlock()
+
+	// A symlink elsewhere must not hide a read of the file it points to
+	details := "Read sensitive file"
+	resolved, evalErr := filepath.EvalSymlinks(path)
+	if evalErr != nil {
+		resolved = path
+	} else if resolved != path {
+		details += " via " + resolved
+	}
+	for _, re := range patterns {
+		if re.MatchString(path) || re.MatchString(resolved) {
+			auditFile(userID, "FILE_READ", path, "", bytes, details, err)
+			return
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/klauspost/compress/zstd"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ==================== VERSION STORAGE ====================
+// File version contents live in a content-addressed blob table: each distinct
+// content is stored once, zstd compressed, keyed by its SHA-256. FileVersion
+// rows only reference a blob. Retention rules prune old versions per path and
+// a garbage collector drops blobs no version references any more.
+
+const (
+	defaultVersionsKeep       = 50        // Versions per path, override with VERSIONS_KEEP (0 = unlimited)
+	defaultVersionsMaxAgeDays = 90        // Override with VERSIONS_MAX_AGE_DAYS (0 = forever)
+	defaultVersionsMaxBytes   = 100 << 20 // Uncompressed bytes per path, override with VERSIONS_MAX_BYTES (0 = unlimited)
+	versionBinarySniffBytes   = 8000
+	versionMigrationBatchSize = 100
+	versionJanitorInterval    = time.Hour
+)
+
+// FileBlob holds one distinct version content
+type FileBlob struct {
+	Hash       string    `gorm:"primaryKey" json:"hash"` // SHA-256 of the uncompressed content
+	Size       int64     `json:"size"`
+	StoredSize int64     `json:"stored_size"`
+	Data       []byte    `json:"-"` // zstd compressed
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+var (
+	blobEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+	blobDecoder, _ = zstd.NewReader(nil)
+)
+
+// isBinaryContent treats content as binary when it has a NUL byte near the
+// start or is not valid UTF-8, since neither survives a JSON string intact.
+func isBinaryContent(data []byte) bool {
+	head := data
+	if len(head) > versionBinarySniffBytes {
+		head = head[:versionBinarySniffBytes]
+	}
+	return bytes.IndexByte(head, 0) >= 0 || !utf8.Valid(data)
+}
+
+// storeBlob saves data under its hash unless that content is already stored
+func storeBlob(tx *gorm.DB, data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	compressed := blobEncoder.EncodeAll(data, nil)
+	blob := FileBlob{
+		Hash:       hash,
+		Size:       int64(len(data)),
+		StoredSize: int64(len(compressed)),
+		Data:       compressed,
+		CreatedAt:  time.Now(),
+	}
+	// Concurrent saves of the same content both get here; the second one is a no-op
+	if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&blob).Error; err != nil {
+		return "", err
+	}
+	return hash, nil
+}
+
+// saveFileVersion snapshots data for path, linked to an activity log entry.
+// Nothing is stored when the content matches the latest version of the path.
+func saveFileVersion(logID uint, path, reason string, data []byte) (*FileVersion, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	var latest FileVersion
+	if err := DB.Select("id, hash").Where("path = ?", path).Order("created_at desc, id desc").First(&latest).Error; err == nil && latest.Hash == hash {
+		return nil, nil
+	}
+
+	version := FileVersion{
+		LogID:     logID,
+		Path:      path,
+		Hash:      hash,
+		Binary:    isBinaryContent(data),
+		Reason:    reason,
+		Size:      int64(len(data)),
+		CreatedAt: time.Now(),
+	}
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if _, err := storeBlob(tx, data); err != nil {
+			return err
+		}
+		return tx.Create(&version).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	pruneFileVersions(path)
+	return &version, nil
+}
+
+// versionData returns the full content of a version
+func versionData(v *FileVersion) ([]byte, error) {
+	if v.Hash == "" {
+		// Snapshot from before blob storage that hasn't been migrated yet
+		return []byte(v.Content), nil
+	}
+	var blob FileBlob
+	if err := DB.First(&blob, "hash = ?", v.Hash).Error; err != nil {
+		return nil, errors.New("version content is missing")
+	}
+	return blobDecoder.DecodeAll(blob.Data, nil)
+}
+
+func initFileVersions() {
+	migrateFileVersions()
+	go versionJanitor()
+}
+
+// migrateFileVersions moves inline snapshot contents into the blob table
+func migrateFileVersions() {
+	migrated := 0
+	for {
+		var batch []FileVersion
+		DB.Where("hash = '' OR hash IS NULL").Limit(versionMigrationBatchSize).Find(&batch)
+		if len(batch) == 0 {
+			break
+		}
+		for _, v := range batch {
+			data := []byte(v.Content)
+			err := DB.Transaction(func(tx *gorm.DB) error {
+				hash, err := storeBlob(tx, data)
+				if err != nil {
+					return err
+				}
+				return tx.Model(&FileVersion{}).Where("id = ?", v.ID).Updates(map[string]interface{}{
+					"hash":    hash,
+					"binary":  isBinaryContent(data),
+					"size":    len(data),
+					"content": "",
+				}).Error
+			})
+			if err != nil {
+				log.Println("versions: failed to migrate version", v.ID, err)
+				return
+			}
+			migrated++
+		}
+	}
+	if migrated > 0 {
+		log.Printf("versions: moved %d snapshots into blob storage", migrated)
+	}
+}
+
+// pruneFileVersions applies the retention rules to one path. The newest
+// version is always kept.
+func pruneFileVersions(path string) int {
+	keep := getSettingInt("VERSIONS_KEEP", defaultVersionsKeep)
+	maxAgeDays := getSettingInt("VERSIONS_MAX_AGE_DAYS", defaultVersionsMaxAgeDays)
+	maxBytes := getSettingInt("VERSIONS_MAX_BYTES", defaultVersionsMaxBytes)
+
+	var versions []FileVersion
+	DB.Select("id, size, created_at").Where("path = ?", path).Order("created_at desc, id desc").Find(&versions)
+
+	cutoff := time.Now().AddDate(0, 0, -int(maxAgeDays))
+	var total int64
+	var expired []uint
+	for i, v := range versions {
+		total += v.Size
+		if i == 0 {
+			continue
+		}
+		if (keep > 0 && int64(i) >= keep) ||
+			(maxAgeDays > 0 && v.CreatedAt.Before(cutoff)) ||
+			(maxBytes > 0 && total > maxBytes) {
+			expired = append(expired, v.ID)
+		}
+	}
+	if len(expired) > 0 {
+		DB.Delete(&FileVersion{}, expired)
+	}
+	return len(expired)
+}
+
+type versionGCStats struct {
+	VersionsPruned int   `json:"versions_pruned"`
+	BlobsDeleted   int64 `json:"blobs_deleted"`
+	BytesFreed     int64 `json:"bytes_freed"` // Compressed bytes
+}
+
+// collectVersionGarbage prunes every path and deletes unreferenced blobs
+func collectVersionGarbage() versionGCStats {
+	var stats versionGCStats
+
+	var paths []string
+	DB.Model(&FileVersion{}).Distinct("path").Pluck("path", &paths)
+	for _, p := range paths {
+		stats.VersionsPruned += pruneFileVersions(p)
+	}
+
+	referenced := func() *gorm.DB { return DB.Model(&FileVersion{}).Select("hash").Where("hash <> ''") }
+	DB.Model(&FileBlob{}).Select("COALESCE(SUM(stored_size), 0)").Where("hash NOT IN (?)", referenced()).Scan(&stats.BytesFreed)
+	res := DB.Where("hash NOT IN (?)", referenced()).Delete(&FileBlob{})
+	stats.BlobsDeleted = res.RowsAffected
+	return stats
+}
+
+func versionJanitor() {
+	ticker := time.NewTicker(versionJanitorInterval)
+	defer ticker.Stop()
+	for {
+		if stats := collectVersionGarbage(); stats.VersionsPruned > 0 || stats.BlobsDeleted > 0 {
+			log.Printf("versions: pruned %d versions, deleted %d blobs (%d bytes)", stats.VersionsPruned, stats.BlobsDeleted, stats.BytesFreed)
+		}
+		<-ticker.C
+	}
+}
+
+// CollectVersionGarbage runs retention and blob GC immediately (admin)
+func CollectVersionGarbage(c *fiber.Ctx) error {
+	return c.JSON(collectVersionGarbage())
+}
+
+// GetVersionStorage reports how much space version history uses
+func GetVersionStorage(c *fiber.Ctx) error {
+	var stats struct {
+		Blobs      int64 `json:"blobs"`
+		Size       int64 `json:"size"`
+		StoredSize int64 `json:"stored_size"`
+	}
+	DB.Model(&FileBlob{}).Select("COUNT(*) AS blobs, COALESCE(SUM(size), 0) AS size, COALESCE(SUM(stored_size), 0) AS stored_size").Scan(&stats)
+	var versions int64
+	DB.Model(&FileVersion{}).Count(&versions)
+	return c.JSON(fiber.Map{"versions": versions, "blobs": stats.Blobs, "size": stats.Size, "stored_size": stats.StoredSize})
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"lukechampine.com/blake3"
+)
+
+// ==================== CHECKSUMS ====================
+// The checksum action hashes a file with one or more algorithms in a single
+// streaming pass, or checks every file listed in a SHA256SUMS style file.
+// Small files are answered directly; larger ones run as background jobs.
+
+const checksumInlineBytes = 4 << 20 // Hashed without starting a job
+
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+	"blake3": func() hash.Hash { return blake3.New(32, nil) },
+}
+
+// parseChecksumAlgorithms reads data.algorithm or data.algorithms, defaulting to sha256
+func parseChecksumAlgorithms(data map[string]interface{}) ([]string, error) {
+	var names []string
+	if list, ok := data["algorithms"].([]interface{}); ok {
+		for _, v := range list {
+			if name, ok := v.(string); ok {
+				names = append(names, strings.ToLower(name))
+			}
+		}
+	} else if name, ok := data["algorithm"].(string); ok && name != "" {
+		names = []string{strings.ToLower(name)}
+	}
+	if len(names) == 0 {
+		names = []string{"sha256"}
+	}
+	for _, name := range names {
+		if _, ok := checksumAlgorithms[name]; !ok {
+			return nil, fmt.Errorf("unknown algorithm %q (md5, sha1, sha256, sha512, blake3)", name)
+		}
+	}
+	return names, nil
+}
+
+// hashFile returns the hex digests of path for each algorithm
+func hashFile(job *fileJob, path string, algorithms []string, progress func(int64)) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", path)
+	}
+
+	hashes := make([]hash.Hash, len(algorithms))
+	writers := make([]io.Writer, len(algorithms))
+	for i, name := range algorithms {
+		hashes[i] = checksumAlgorithms[name]()
+		writers[i] = hashes[i]
+	}
+	var r io.Reader = f
+	if progress != nil {
+		r = &countingReader{r: f, progress: progress}
+	}
+	mw := io.MultiWriter(writers...)
+	buf := make([]byte, 1<<20)
+	for {
+		if job != nil {
+			if err := job.ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+		n, err := r.Read(buf)
+		if n > 0 {
+			mw.Write(buf[:n])
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sums := make(map[string]string, len(algorithms))
+	for i, name := range algorithms {
+		sums[name] = hex.EncodeToString(hashes[i].Sum(nil))
+	}
+	return sums, nil
+}
+
+// checksumEntry is one line of a checksums file
+type checksumEntry struct {
+	Name      string
+	Algorithm string
+	Expected  string
+}
+
+// GNU coreutils ("<hex>  name", "<hex> *name") and BSD ("SHA256 (name) = <hex>") formats
+var (
+	gnuChecksumLine = regexp.MustCompile(`^\\?([0-9a-fA-F]+) [ *](.+)$`)
+	bsdChecksumLine = regexp.MustCompile(`^\\?([A-Za-z0-9-]+) ?\((.+)\) ?= ?([0-9a-fA-F]+)$`)
+)
+
+// parseChecksumFile reads a sums file. Lines without an algorithm name get
+// algorithm, or one guessed from the digest length.
+func parseChecksumFile(path, algorithm string) ([]checksumEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []checksumEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if m := bsdChecksumLine.FindStringSubmatch(line); m != nil {
+			name := strings.ToLower(strings.ReplaceAll(m[1], "-", ""))
+			if _, ok := checksumAlgorithms[name]; !ok {
+				return nil, fmt.Errorf("line %d: unknown algorithm %s", lineNo, m[1])
+			}
+			entries = append(entries, checksumEntry{Name: m[2], Algorithm: name, Expected: strings.ToLower(m[3])})
+			continue
+		}
+		m := gnuChecksumLine.FindStringSubmatch(line)
+		if m == nil {
+			return nil, fmt.Errorf("line %d: not a checksum line", lineNo)
+		}
+		name := algorithm
+		if name == "" {
+			switch len(m[1]) {
+			case 32:
+				name = "md5"
+			case 40:
+				name = "sha1"
+			case 64:
+				name = "sha256"
+			case 128:
+				name = "sha512"
+			default:
+				return nil, fmt.Errorf("line %d: can't tell the algorithm of a %d digit digest", lineNo, len(m[1]))
+			}
+		}
+		entries = append(entries, checksumEntry{Name: m[2], Algorithm: name, Expected: strings.ToLower(m[1])})
+	}
+	return entries, scanner.Err()
+}
+
+type checksumMismatch struct {
+	Path      string `json:"path"`
+	Algorithm string `json:"algorithm"`
+	Expected  string `json:"expected"`
+	Actual    string `json:"actual"`
+}
+
+type checksumFailure struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+// verifyChecksums checks every entry of a sums file against the files in dir
+// (names are relative to it, like sha256sum -c)
+func verifyChecksums(job *fileJob, sumsPath, dir, algorithm string) (map[string]interface{}, error) {
+	entries, err := parseChecksumFile(sumsPath, algorithm)
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, len(entries))
+	var total int64
+	for i, entry := range entries {
+		paths[i] = entry.Name
+		if !filepath.IsAbs(paths[i]) {
+			paths[i] = filepath.Join(dir, paths[i])
+		}
+		if info, err := os.Stat(paths[i]); err == nil {
+			total += info.Size()
+		}
+	}
+	atomic.StoreInt64(&job.Total, total)
+
+	var ok int
+	mismatched := []checksumMismatch{}
+	missing := []string{}
+	failed := []checksumFailure{}
+	for i, entry := range entries {
+		sums, err := hashFile(job, paths[i], []string{entry.Algorithm}, job.progress)
+		switch {
+		case job.ctx.Err() != nil:
+			return nil, job.ctx.Err()
+		case os.IsNotExist(err):
+			missing = append(missing, paths[i])
+		case err != nil:
+			failed = append(failed, checksumFailure{Path: paths[i], Error: err.Error()})
+		case sums[entry.Algorithm] != entry.Expected:
+			mismatched = append(mismatched, checksumMismatch{Path: paths[i], Algorithm: entry.Algorithm, Expected: entry.Expected, Actual: sums[entry.Algorithm]})
+		default:
+			ok++
+		}
+	}
+	sort.Strings(missing)
+	return map[string]interface{}{
+		"sums":       sumsPath,
+		"dir":        dir,
+		"checked":    len(entries),
+		"ok":         ok,
+		"mismatched": mismatched,
+		"missing":    missing,
+		"failed":     failed,
+		"valid":      len(mismatched) == 0 && len(missing) == 0 && len(failed) == 0,
+	}, nil
+}
+
+// checksumResult builds the response for a hashed file, comparing the first
+// algorithm's digest with expected when given
+func checksumResult(path string, size int64, sums map[string]string, algorithms []string, expected string) map[string]interface{} {
+	result := map[string]interface{}{"path": path, "size": size, "checksums": sums}
+	if expected != "" {
+		result["match"] = strings.EqualFold(strings.TrimSpace(expected), sums[algorithms[0]])
+	}
+	return result
+}
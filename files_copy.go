@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+// ==================== NATIVE COPY / MOVE ====================
+// copy and move run as background jobs. When the destination exists a
+// conflict policy decides what happens:
+//   error     - fail (default)
+//   overwrite - merge directories, replace conflicting files
+//   skip      - merge directories, keep existing files
+//   rename    - use a free "name (n).ext" instead
+
+const (
+	conflictError     = "error"
+	conflictOverwrite = "overwrite"
+	conflictSkip      = "skip"
+	conflictRename    = "rename"
+)
+
+func parseConflictPolicy(v interface{}) (string, error) {
+	policy, _ := v.(string)
+	switch policy {
+	case "":
+		return conflictError, nil
+	case conflictError, conflictOverwrite, conflictSkip, conflictRename:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown conflict policy %q", policy)
+}
+
+// uniqueName returns the first "name (n).ext" next to path that doesn't exist
+func uniqueName(path string) string {
+	ext := filepath.Ext(path)
+	if info, err := os.Lstat(path); err == nil && info.IsDir() {
+		ext = ""
+	}
+	base := strings.TrimSuffix(path, ext)
+	for n := 1; ; n++ {
+		candidate := fmt.Sprintf("%s (%d)%s", base, n, ext)
+		if _, err := os.Lstat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+	}
+}
+
+// resolveDestination applies the policy to the top-level destination. The
+// into-itself check runs on the result, so duplicating a path next to
+// itself with the rename policy works.
+func resolveDestination(src, dst, policy string) (string, error) {
+	if _, err := os.Lstat(dst); err == nil {
+		switch policy {
+		case conflictRename:
+			dst = uniqueName(dst)
+		case conflictOverwrite, conflictSkip:
+		default:
+			return "", fmt.Errorf("%s already exists: %w", dst, os.ErrExist)
+		}
+	}
+	if pathWithin(dst, src) {
+		return "", errors.New("cannot copy or move a path into itself")
+	}
+	return dst, nil
+}
+
+// copyWithPolicy copies src to dst resolving conflicts with policy. skipped
+// is called for every entry left alone. Returns the destination used.
+func copyWithPolicy(ctx context.Context, src, dst, policy string, progress func(int64), skipped func(string)) (string, error) {
+	dst, err := resolveDestination(src, dst, policy)
+	if err != nil {
+		return "", err
+	}
+	return dst, filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(src, path)
+		target := filepath.Join(dst, rel)
+
+		if existing, err := os.Lstat(target); err == nil {
+			if info.IsDir() && existing.IsDir() {
+				return nil // Merge
+			}
+			switch policy {
+			case conflictSkip:
+				skipped(path)
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			case conflictRename:
+				target = uniqueName(target)
+			default:
+				// Remove rather than truncate so a symlink at target isn't written through
+				if err := os.RemoveAll(target); err != nil {
+					return err
+				}
+			}
+		}
+
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm())
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			return copyRegularFile(ctx, path, target, info.Mode(), progress)
+		}
+		return nil
+	})
+}
+
+// moveWithPolicy moves src to dst resolving conflicts with policy. When
+// merging into an existing directory, skipped entries stay in src.
+func moveWithPolicy(ctx context.Context, src, dst, policy string, progress func(int64), skipped func(string)) (string, error) {
+	dst, err := resolveDestination(src, dst, policy)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Lstat(dst); os.IsNotExist(err) {
+		return dst, movePath(ctx, src, dst, progress)
+	}
+
+	err = filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(src, path)
+		target := filepath.Join(dst, rel)
+
+		existing, err := os.Lstat(target)
+		if os.IsNotExist(err) {
+			// Nothing in the way: move the whole entry (subtree) at once
+			if err := movePath(ctx, path, target, progress); err != nil {
+				return err
+			}
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() && existing.IsDir() {
+			return nil // Merge
+		}
+		switch policy {
+		case conflictSkip:
+			skipped(path)
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		case conflictRename:
+			target = uniqueName(target)
+		default:
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+		}
+		if err := movePath(ctx, path, target, progress); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return dst, err
+	}
+	removeEmptyDirs(src)
+	return dst, nil
+}
+
+// removeEmptyDirs deletes directories under (and including) root that are
+// left empty, deepest first
+func removeEmptyDirs(root string) {
+	var dirs []string
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Remove(dirs[i]) // Fails harmlessly on non-empty directories
+	}
+}
+
+// copyTree copies src (file, symlink or directory) to dst, preserving modes
+// and symlinks. progress receives bytes copied and may be nil.
+func copyTree(ctx context.Context, src, dst string, progress func(int64)) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(src, path)
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm())
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			return copyRegularFile(ctx, path, target, info.Mode(), progress)
+		}
+		// Sockets, devices and FIFOs are not copied
+		return nil
+	})
+}
+
+func copyRegularFile(ctx context.Context, src, dst string, mode fs.FileMode, progress func(int64)) error {
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode.Perm())
+	if err != nil {
+		return err
+	}
+	if err := copyFileInto(ctx, out, src, progress); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// movePath renames src to dst, falling back to copy + delete when they are
+// on different filesystems.
+func movePath(ctx context.Context, src, dst string, progress func(int64)) error {
+	err := os.Rename(src, dst)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	if err := copyTree(ctx, src, dst, progress); err != nil {
+		os.RemoveAll(dst)
+		return err
+	}
+	return os.RemoveAll(src)
+}
+
+// startTransferJob runs a copy or move as a background job and audits it.
+// previous holds snapshots taken by a rename that fell back to a move; they
+// are linked to the job's log entry once it succeeds.
+func startTransferJob(c *filesConn, kind, src, dst, policy string, previous []fileSnapshot, requestId interface{}) *fileJob {
+	return startFileJob(c, kind, src, dst, requestId, func(job *fileJob) error {
+		atomic.StoreInt64(&job.Total, treeSize(job.Path))
+		skipped := func(string) { atomic.AddInt64(&job.Skipped, 1) }
+
+		var final string
+		var err error
+		action, details := "FILE_COPY", "Copy"
+		if kind == "move" {
+			action, details = "FILE_MOVE", "Move"
+			final, err = moveWithPolicy(job.ctx, job.Path, job.Target, policy, job.progress, skipped)
+		} else {
+			final, err = copyWithPolicy(job.ctx, job.Path, job.Target, policy, job.progress, skipped)
+		}
+		if final != "" {
+			fileJobs.Lock()
+			job.Target = final
+			fileJobs.Unlock()
+		}
+		if n := atomic.LoadInt64(&job.Skipped); n > 0 {
+			details += fmt.Sprintf(" (%d skipped)", n)
+		}
+		logEntry := auditFile(job.UserID, action, job.Path, job.Target, atomic.LoadInt64(&job.Done), details, err)
+		if kind == "move" && err == nil {
+			saveSnapshots(logEntry.ID, "pre_rename", previous)
+			c.moveWatches(job.Path, job.Target)
+		}
+		return err
+	})
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Pasting into the same folder with the rename policy duplicates the entry
+func TestCopyIntoOwnParentRenames(t *testing.T) {
+	root := t.TempDir()
+	file := filepath.Join(root, "notes.txt")
+	dir := filepath.Join(root, "dir")
+	if err := os.WriteFile(file, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "inner"), []byte("inner"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	noop := func(int64) {}
+	skipped := func(path string) { t.Errorf("unexpected skip of %s", path) }
+	for src, want := range map[string]string{
+		file: filepath.Join(root, "notes (1).txt"),
+		dir:  filepath.Join(root, "dir (1)"),
+	} {
+		got, err := copyWithPolicy(context.Background(), src, src, conflictRename, noop, skipped)
+		if err != nil {
+			t.Fatalf("copy %s: %v", src, err)
+		}
+		if got != want {
+			t.Errorf("copy %s landed at %s, want %s", src, got, want)
+		}
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "dir (1)", "inner")); string(data) != "inner" {
+		t.Errorf("copied folder content = %q", data)
+	}
+}
+
+// Any other policy must still refuse to copy a folder into itself
+func TestCopyIntoItselfFails(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "dir")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, dst := range []string{dir, filepath.Join(dir, "sub")} {
+		if _, err := copyWithPolicy(context.Background(), dir, dst, conflictOverwrite, func(int64) {}, func(string) {}); err == nil {
+			t.Errorf("copy of %s to %s succeeded", dir, dst)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ==================== EDIT CONCURRENCY ====================
+// read returns a version token for the file; write can pass it back as
+// expectedToken and is rejected with the current content if the file changed
+// in the meantime. Editors can also take advisory locks so other users see
+// who is editing a file.
+
+const (
+	defaultEditLockTTL = 5 * time.Minute // Refreshed by calling lock again
+	maxEditLockTTL     = time.Hour
+)
+
+// fileToken identifies one state of a file: mtime, size and content hash
+func fileToken(info os.FileInfo, data []byte) string {
+	sum := sha256.Sum256(data)
+	return fmt.Sprintf("%x-%x-%s", info.ModTime().UnixNano(), info.Size(), hex.EncodeToString(sum[:8]))
+}
+
+// currentFileToken reads path and returns its token and content.
+// A missing file has an empty token.
+func currentFileToken(path string) (string, []byte, error) {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return "", nil, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", nil, err
+	}
+	return fileToken(info, data), data, nil
+}
+
+// Serializes token checks and writes per path so two writers holding the
+// same token can't both succeed
+type editPathLock struct {
+	sync.Mutex
+	refs int // Holder plus waiters; the entry goes away when it drops to 0
+}
+
+var editPathLocks = struct {
+	sync.Mutex
+	m map[string]*editPathLock
+}{m: make(map[string]*editPathLock)}
+
+func lockEditPath(path string) func() {
+	editPathLocks.Lock()
+	lock := editPathLocks.m[path]
+	if lock == nil {
+		lock = &editPathLock{}
+		editPathLocks.m[path] = lock
+	}
+	lock.refs++
+	editPathLocks.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		editPathLocks.Lock()
+		if lock.refs--; lock.refs == 0 {
+			delete(editPathLocks.m, path)
+		}
+		editPathLocks.Unlock()
+	}
+}
+
+type editLock struct {
+	Path       string    `json:"path"`
+	UserID     uint      `json:"user_id"`
+	Username   string    `json:"username"`
+	AcquiredAt time.Time `json:"acquired_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+
+	conn *filesConn
+}
+
+var editLocks = struct {
+	sync.Mutex
+	m map[string]*editLock
+}{m: make(map[string]*editLock)}
+
+// activeEditLock returns the unexpired lock on path, if any
+func activeEditLock(path string) *editLock {
+	editLocks.Lock()
+	defer editLocks.Unlock()
+	lock := editLocks.m[path]
+	if lock == nil {
+		return nil
+	}
+	if time.Now().After(lock.ExpiresAt) {
+		delete(editLocks.m, path)
+		return nil
+	}
+	held := *lock
+	return &held
+}
+
+// acquireEditLock takes or refreshes the lock on path for the connection's
+// user. Another user's lock can only be taken over with force (admin).
+func acquireEditLock(c *filesConn, path string, ttl time.Duration, force bool) (*editLock, error) {
+	if ttl <= 0 {
+		ttl = defaultEditLockTTL
+	}
+	if ttl > maxEditLockTTL {
+		ttl = maxEditLockTTL
+	}
+
+	var username string
+	var user User
+	if err := DB.Select("username").First(&user, c.userID).Error; err == nil {
+		username = user.Username
+	}
+
+	editLocks.Lock()
+	defer editLocks.Unlock()
+	now := time.Now()
+	if held := editLocks.m[path]; held != nil && now.Before(held.ExpiresAt) && held.UserID != c.userID {
+		if !force || c.role != "admin" {
+			return nil, fmt.Errorf("%s is being edited by %s until %s", path, held.Username, held.ExpiresAt.Format(time.RFC3339))
+		}
+	}
+	lock := editLocks.m[path]
+	if lock == nil || lock.UserID != c.userID || now.After(lock.ExpiresAt) {
+		lock = &editLock{Path: path, UserID: c.userID, Username: username, AcquiredAt: now}
+		editLocks.m[path] = lock
+	}
+	lock.ExpiresAt = now.Add(ttl)
+	lock.conn = c
+	held := *lock
+	return &held, nil
+}
+
+// releaseEditLock drops the user's lock on path; admins can release any lock
+func releaseEditLock(c *filesConn, path string) error {
+	editLocks.Lock()
+	defer editLocks.Unlock()
+	lock := editLocks.m[path]
+	if lock == nil || time.Now().After(lock.ExpiresAt) {
+		delete(editLocks.m, path)
+		return fmt.Errorf("%s is not locked", path)
+	}
+	if lock.UserID != c.userID && c.role != "admin" {
+		return fmt.Errorf("%s is locked by %s", path, lock.Username)
+	}
+	delete(editLocks.m, path)
+	return nil
+}
+
+// releaseConnLocks drops every lock taken through a connection when it closes
+func releaseConnLocks(c *filesConn) {
+	editLocks.Lock()
+	defer editLocks.Unlock()
+	for path, lock := range editLocks.m {
+		if lock.conn == c {
+			delete(editLocks.m, path)
+		}
+	}
+}
+
+// listEditLocks returns unexpired locks, sorted by path
+func listEditLocks() []editLock {
+	editLocks.Lock()
+	defer editLocks.Unlock()
+	now := time.Now()
+	locks := []editLock{}
+	for path, lock := range editLocks.m {
+		if now.After(lock.ExpiresAt) {
+			delete(editLocks.m, path)
+			continue
+		}
+		locks = append(locks, *lock)
+	}
+	sort.Slice(locks, func(i, j int) bool { return locks[i].Path < locks[j].Path })
+	return locks
+}
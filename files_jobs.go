@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/contrib/websocket"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ==================== FILES CONNECTION & BACKGROUND JOBS ====================
+
+// filesConn wraps a files WebSocket so background jobs can push events
+// while the read loop keeps serving requests.
+type filesConn struct {
+	*websocket.Conn
+	mu     sync.Mutex
+	userID uint
+	role   string
+
+	watchMu sync.Mutex
+	watcher *dirWatcher // Created by the first watch action
+}
+
+func newFilesConn(c *websocket.Conn) *filesConn {
+	fc := &filesConn{Conn: c}
+	if claims, ok := c.Locals("user").(jwt.MapClaims); ok {
+		userIdFloat, _ := claims["iss"].(float64)
+		fc.userID = uint(userIdFloat)
+		fc.role, _ = claims["role"].(string)
+	}
+	return fc
+}
+
+// WriteJSON is safe for concurrent use and stamps messages with the protocol version
+func (fc *filesConn) WriteJSON(v interface{}) error {
+	if m, ok := v.(map[string]interface{}); ok {
+		m["v"] = filesProtocolVersion
+	}
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.Conn.WriteJSON(v)
+}
+
+// fileJob is a long-running file operation (archive, extract, ...) that
+// reports progress over the WebSocket that started it.
+type fileJob struct {
+	ID        string    `json:"id"`
+	Kind      string    `json:"kind"`
+	UserID    uint      `json:"user_id"`
+	Path      string    `json:"path"`
+	Target    string    `json:"target"`
+	Status    string    `json:"status"` // running, done, failed, cancelled
+	Done      int64     `json:"done"`   // bytes processed so far
+	Total     int64     `json:"total"`  // 0 when unknown
+	Skipped   int64     `json:"skipped,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	conn      *filesConn
+	requestId interface{}
+	lastEvent time.Time
+}
+
+var fileJobs = struct {
+	sync.Mutex
+	m map[string]*fileJob
+}{m: make(map[string]*fileJob)}
+
+const jobProgressInterval = 500 * time.Millisecond
+
+// startFileJob runs fn in the background and reports job_progress / job_done events
+func startFileJob(c *filesConn, kind, path, target string, requestId interface{}, fn func(job *fileJob) error) *fileJob {
+	idBytes := make([]byte, 8)
+	rand.Read(idBytes)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &fileJob{
+		ID:        hex.EncodeToString(idBytes),
+		Kind:      kind,
+		UserID:    c.userID,
+		Path:      path,
+		Target:    target,
+		Status:    "running",
+		StartedAt: time.Now(),
+		ctx:       ctx,
+		cancel:    cancel,
+		conn:      c,
+		requestId: requestId,
+	}
+
+	fileJobs.Lock()
+	fileJobs.m[job.ID] = job
+	fileJobs.Unlock()
+
+	go func() {
+		defer cancel()
+		err := fn(job)
+
+		fileJobs.Lock()
+		switch {
+		case err == nil:
+			job.Status = "done"
+		case ctx.Err() != nil:
+			job.Status = "cancelled"
+		default:
+			job.Status = "failed"
+			job.Error = err.Error()
+		}
+		delete(fileJobs.m, job.ID)
+		fileJobs.Unlock()
+
+		done := map[string]interface{}{
+			"action":    "job_done",
+			"requestId": job.requestId,
+			"success":   job.Status == "done",
+			"error":     job.Error,
+			"data":      job.snapshot(),
+		}
+		if err != nil {
+			done["code"] = errorCode(err)
+		}
+		job.conn.WriteJSON(done)
+	}()
+
+	return job
+}
+
+// snapshot returns a copy safe to serialize while the job keeps running
+func (job *fileJob) snapshot() fileJob {
+	return fileJob{
+		ID:        job.ID,
+		Kind:      job.Kind,
+		UserID:    job.UserID,
+		Path:      job.Path,
+		Target:    job.Target,
+		Status:    job.Status,
+		Done:      atomic.LoadInt64(&job.Done),
+		Total:     atomic.LoadInt64(&job.Total),
+		Skipped:   atomic.LoadInt64(&job.Skipped),
+		Error:     job.Error,
+		StartedAt: job.StartedAt,
+	}
+}
+
+// progress adds n processed bytes and emits a throttled job_progress event
+func (job *fileJob) progress(n int64) {
+	atomic.AddInt64(&job.Done, n)
+	if time.Since(job.lastEvent) < jobProgressInterval {
+		return
+	}
+	job.lastEvent = time.Now()
+	job.conn.WriteJSON(map[string]interface{}{
+		"action":    "job_progress",
+		"requestId": job.requestId,
+		"data":      job.snapshot(),
+	})
+}
+
+// listFileJobs returns running jobs, only userID's unless all is set
+func listFileJobs(userID uint, all bool) []fileJob {
+	fileJobs.Lock()
+	defer fileJobs.Unlock()
+	jobs := []fileJob{}
+	for _, job := range fileJobs.m {
+		if all || job.UserID == userID {
+			jobs = append(jobs, job.snapshot())
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].StartedAt.Before(jobs[j].StartedAt) })
+	return jobs
+}
+
+// cancelFileJob stops a job owned by userID (admins may cancel any job)
+func cancelFileJob(id string, userID uint, isAdmin bool) bool {
+	fileJobs.Lock()
+	defer fileJobs.Unlock()
+	job, ok := fileJobs.m[id]
+	if !ok || (job.UserID != userID && !isAdmin) {
+		return false
+	}
+	job.cancel()
+	return true
+}
+
+// cancelConnJobs stops jobs of the given kinds started on c, whose results
+// are only useful to that connection (e.g. searches once the tab is closed)
+func cancelConnJobs(c *filesConn, kinds ...string) {
+	fileJobs.Lock()
+	defer fileJobs.Unlock()
+	for _, job := range fileJobs.m {
+		if job.conn != c {
+			continue
+		}
+		for _, kind := range kinds {
+			if job.Kind == kind {
+				job.cancel()
+			}
+		}
+	}
+}
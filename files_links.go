@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// ==================== LINKS ====================
+// list follows symlinks so a link to a directory can be opened like one, and
+// reports where each link points. symlink and hardlink create links; the
+// rules for who may link to what are checked against the resolved target,
+// never the name the client passed.
+
+// fileTypeName names the type of a file mode the way list reports it
+func fileTypeName(mode fs.FileMode) string {
+	switch {
+	case mode.IsDir():
+		return "folder"
+	case mode.IsRegular():
+		return "file"
+	case mode&fs.ModeSymlink != 0:
+		return "symlink"
+	case mode&fs.ModeSocket != 0:
+		return "socket"
+	case mode&fs.ModeNamedPipe != 0:
+		return "pipe"
+	case mode&fs.ModeDevice != 0:
+		return "device"
+	}
+	return "other"
+}
+
+// listEntry describes one directory entry. Symlinks get their target, the
+// target's type and whether it is broken; a link to a directory is listed
+// as a folder so it can be navigated into.
+func listEntry(dir string, e fs.DirEntry) map[string]interface{} {
+	entry := map[string]interface{}{
+		"name":  e.Name(),
+		"type":  fileTypeName(e.Type()),
+		"isDir": e.IsDir(),
+	}
+	info, err := e.Info()
+	if err != nil {
+		// Removed since ReadDir
+		entry["size"] = int64(0)
+		return entry
+	}
+	entry["size"] = info.Size()
+	entry["mode"] = info.Mode().String()
+	entry["mod"] = info.ModTime().String()
+	if info.Mode()&fs.ModeSymlink == 0 {
+		entry["type"] = fileTypeName(info.Mode())
+		if entry["type"] != "folder" && entry["type"] != "file" {
+			entry["type"] = "file" // Devices, sockets etc. open like files
+			entry["fileType"] = fileTypeName(info.Mode())
+		}
+		return entry
+	}
+
+	path := filepath.Join(dir, e.Name())
+	entry["isLink"] = true
+	entry["linkTarget"], _ = os.Readlink(path)
+	target, err := os.Stat(path)
+	if err != nil {
+		entry["brokenLink"] = true
+		entry["type"] = "file"
+		return entry
+	}
+	entry["brokenLink"] = false
+	entry["targetType"] = fileTypeName(target.Mode())
+	entry["isDir"] = target.IsDir()
+	entry["type"] = "file"
+	if target.IsDir() {
+		entry["type"] = "folder"
+	} else {
+		entry["size"] = target.Size()
+	}
+	return entry
+}
+
+// resolveLinkTarget returns the absolute, symlink-free path a link created
+// at linkPath pointing at target would reach. A missing target (dangling
+// symlink) resolves as far as its existing parent.
+func resolveLinkTarget(linkPath, target string) (string, error) {
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(linkPath), target)
+	}
+	target = filepath.Clean(target)
+	if resolved, err := filepath.EvalSymlinks(target); err == nil {
+		return resolved, nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+	parent, err := filepath.EvalSymlinks(filepath.Dir(target))
+	if err != nil {
+		return target, nil
+	}
+	return filepath.Join(parent, filepath.Base(target)), nil
+}
+
+// allowLinkTarget applies the linking rules to a resolved target. Like
+// chmod, only admins may deal in setuid/setgid files: a hard link keeps an
+// old setuid binary around after it is upgraded. The target is only checked
+// now, so non-admins can't link to a path that doesn't exist yet either.
+func allowLinkTarget(c *filesConn, resolved string) error {
+	if c.role == "admin" {
+		return nil
+	}
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return fmt.Errorf("only admins can link to a missing target: %w", err)
+	}
+	if info.Mode()&(os.ModeSetuid|os.ModeSetgid) != 0 {
+		return errors.New("Only admins can link to setuid or setgid files")
+	}
+	return nil
+}
+
+// createSymlink makes linkPath point at target, which is stored as given
+// (relative targets stay relative)
+func createSymlink(c *filesConn, target, linkPath string) (string, error) {
+	if target == "" {
+		return "", errors.New("target required")
+	}
+	resolved, err := resolveLinkTarget(linkPath, target)
+	if err != nil {
+		return "", err
+	}
+	if err := allowLinkTarget(c, resolved); err != nil {
+		return resolved, err
+	}
+	return resolved, os.Symlink(target, linkPath)
+}
+
+// createHardlink links linkPath to the existing file target
+func createHardlink(c *filesConn, target, linkPath string) (string, error) {
+	if target == "" {
+		return "", errors.New("target required")
+	}
+	resolved, err := resolveLinkTarget(linkPath, target)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return resolved, err
+	}
+	if info.IsDir() {
+		return resolved, fmt.Errorf("can't hard link %s: %w", target, syscall.EISDIR)
+	}
+	if err := allowLinkTarget(c, resolved); err != nil {
+		return resolved, err
+	}
+	return resolved, os.Link(resolved, linkPath)
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/sys/unix"
+)
+
+// ==================== PERMISSIONS & METADATA ====================
+// chmod, chown and stat file actions.
+
+const specialModeBits = os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// parseFileMode accepts an octal string ("755", "0644", "4755") or a JSON number
+// already written in octal digits
+func parseFileMode(v interface{}) (os.FileMode, error) {
+	var s string
+	switch val := v.(type) {
+	case string:
+		s = val
+	case float64:
+		s = strconv.Itoa(int(val))
+	default:
+		return 0, errors.New("mode required")
+	}
+	n, err := strconv.ParseUint(strings.TrimPrefix(s, "0o"), 8, 32)
+	if err != nil || n > 07777 {
+		return 0, fmt.Errorf("invalid mode %q", s)
+	}
+	mode := os.FileMode(n & 0777)
+	if n&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if n&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if n&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode, nil
+}
+
+// chmodPath applies mode to path (and everything below it when recursive).
+// dirMode, when non-zero, is used for directories instead. chmod would
+// follow symlinks, and Linux has no lchmod, so a symlink path is refused
+// and symlinks below it are skipped. Returns entries changed.
+func chmodPath(path string, mode, dirMode os.FileMode, recursive bool) (int, error) {
+	if dirMode == 0 {
+		dirMode = mode
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		return 0, err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return 0, &os.PathError{Op: "chmod", Path: path, Err: unix.EOPNOTSUPP}
+	}
+	if !recursive {
+		if info.IsDir() {
+			mode = dirMode
+		}
+		return 1, os.Chmod(path, mode)
+	}
+	changed := 0
+	err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type()&fs.ModeSymlink != 0 {
+			return nil
+		}
+		m := mode
+		if d.IsDir() {
+			m = dirMode
+		}
+		if err := os.Chmod(p, m); err != nil {
+			return err
+		}
+		changed++
+		return nil
+	})
+	return changed, err
+}
+
+// lookupOwner resolves user and group names (or numeric ids) to uid/gid; -1 leaves it unchanged
+func lookupOwner(userName, groupName string) (int, int, error) {
+	uid, gid := -1, -1
+	if userName != "" {
+		u, err := user.Lookup(userName)
+		if err != nil {
+			if u, err = user.LookupId(userName); err != nil {
+				return 0, 0, fmt.Errorf("unknown user %q", userName)
+			}
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+	}
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			if g, err = user.LookupGroupId(groupName); err != nil {
+				return 0, 0, fmt.Errorf("unknown group %q", groupName)
+			}
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	return uid, gid, nil
+}
+
+// chownPath changes ownership without following symlinks. Returns entries changed.
+func chownPath(path string, uid, gid int, recursive bool) (int, error) {
+	if !recursive {
+		return 1, os.Lchown(path, uid, gid)
+	}
+	changed := 0
+	err := filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := os.Lchown(p, uid, gid); err != nil {
+			return err
+		}
+		changed++
+		return nil
+	})
+	return changed, err
+}
+
+type aclEntry struct {
+	Tag  string `json:"tag"` // user_obj, user, group_obj, group, mask, other
+	Qual string `json:"qualifier,omitempty"`
+	Perm string `json:"perm"`
+}
+
+// statPath gathers extended metadata without following a final symlink
+func statPath(path string) (map[string]interface{}, error) {
+	var st unix.Stat_t
+	if err := unix.Lstat(path, &st); err != nil {
+		return nil, err
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	owner := strconv.Itoa(int(st.Uid))
+	if u, err := user.LookupId(owner); err == nil {
+		owner = u.Username
+	}
+	group := strconv.Itoa(int(st.Gid))
+	if g, err := user.LookupGroupId(group); err == nil {
+		group = g.Name
+	}
+
+	result := map[string]interface{}{
+		"path":  path,
+		"name":  info.Name(),
+		"size":  st.Size,
+		"mode":  info.Mode().String(),
+		"octal": fmt.Sprintf("%04o", st.Mode&07777),
+		"isDir": info.IsDir(),
+		"uid":   st.Uid,
+		"gid":   st.Gid,
+		"owner": owner,
+		"group": group,
+		"inode": st.Ino,
+		"nlink": st.Nlink,
+		"dev":   st.Dev,
+		"atime": time.Unix(st.Atim.Unix()),
+		"mtime": time.Unix(st.Mtim.Unix()),
+		"ctime": time.Unix(st.Ctim.Unix()),
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, _ := os.Readlink(path)
+		result["linkTarget"] = target
+		targetInfo, err := os.Stat(path)
+		result["brokenLink"] = err != nil
+		if err == nil {
+			result["targetType"] = fileTypeName(targetInfo.Mode())
+		}
+	}
+
+	xattrs := map[string]string{}
+	for _, name := range listXattrs(path) {
+		buf := make([]byte, 64*1024)
+		n, err := unix.Lgetxattr(path, name, buf)
+		if err != nil {
+			continue
+		}
+		switch name {
+		case "system.posix_acl_access":
+			result["acl"] = decodePosixACL(buf[:n])
+		case "system.posix_acl_default":
+			result["defaultAcl"] = decodePosixACL(buf[:n])
+		default:
+			if utf8.Valid(buf[:n]) {
+				xattrs[name] = string(buf[:n])
+			} else {
+				xattrs[name] = fmt.Sprintf("0x%x", buf[:n])
+			}
+		}
+	}
+	result["xattrs"] = xattrs
+
+	return result, nil
+}
+
+func listXattrs(path string) []string {
+	buf := make([]byte, 64*1024)
+	n, err := unix.Llistxattr(path, buf)
+	if err != nil || n <= 0 {
+		return nil
+	}
+	var names []string
+	for _, name := range strings.Split(string(buf[:n]), "\x00") {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// decodePosixACL parses the Linux xattr ACL format: a 4-byte version header
+// followed by 8-byte entries (tag u16, perm u16, id u32), little endian.
+func decodePosixACL(data []byte) []aclEntry {
+	if len(data) < 4 || binary.LittleEndian.Uint32(data) != 2 {
+		return nil
+	}
+	var entries []aclEntry
+	for off := 4; off+8 <= len(data); off += 8 {
+		tag := binary.LittleEndian.Uint16(data[off:])
+		perm := binary.LittleEndian.Uint16(data[off+2:])
+		id := binary.LittleEndian.Uint32(data[off+4:])
+
+		entry := aclEntry{Perm: rwxString(perm)}
+		switch tag {
+		case 0x01:
+			entry.Tag = "user_obj"
+		case 0x02:
+			entry.Tag = "user"
+			entry.Qual = strconv.Itoa(int(id))
+			if u, err := user.LookupId(entry.Qual); err == nil {
+				entry.Qual = u.Username
+			}
+		case 0x04:
+			entry.Tag = "group_obj"
+		case 0x08:
+			entry.Tag = "group"
+			entry.Qual = strconv.Itoa(int(id))
+			if g, err := user.LookupGroupId(entry.Qual); err == nil {
+				entry.Qual = g.Name
+			}
+		case 0x10:
+			entry.Tag = "mask"
+		case 0x20:
+			entry.Tag = "other"
+		default:
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func rwxString(perm uint16) string {
+	b := []byte("---")
+	if perm&4 != 0 {
+		b[0] = 'r'
+	}
+	if perm&2 != 0 {
+		b[1] = 'w'
+	}
+	if perm&1 != 0 {
+		b[2] = 'x'
+	}
+	return string(b)
+}
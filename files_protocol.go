@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// ==================== FILES PROTOCOL ====================
+// Every message on the files WebSocket carries "v". Responses to a request
+// also carry its action, its requestId (top-level in v2, inside data in v1)
+// and success; failures add an errno-style "code" next to the message:
+//
+//	{"v":2,"action":"rm","requestId":7,"success":false,"error":"...","code":"ENOENT"}
+
+const (
+	filesProtocolVersion = 2
+	defaultFilesWorkers  = 4 // Concurrent requests per connection, override with FILES_WORKERS
+)
+
+// requestID returns the client's id for matching the response, if any
+func (req *FileReq) requestID() interface{} {
+	if req.RequestID != nil {
+		return req.RequestID
+	}
+	return req.Data["requestId"]
+}
+
+// reply fills in the envelope fields of resp and sends it. "error" may be an
+// error value, in which case its code is derived from it.
+func (c *filesConn) reply(req *FileReq, resp map[string]interface{}) {
+	if _, ok := resp["action"]; !ok {
+		resp["action"] = req.Action
+	}
+	if _, ok := resp["requestId"]; !ok {
+		resp["requestId"] = req.requestID()
+	}
+	switch e := resp["error"].(type) {
+	case error:
+		resp["error"] = e.Error()
+		if _, ok := resp["code"]; !ok {
+			resp["code"] = errorCode(e)
+		}
+		resp["success"] = false
+	case string:
+		if _, ok := resp["code"]; !ok {
+			resp["code"] = "EINVAL"
+		}
+		resp["success"] = false
+	default:
+		if _, ok := resp["success"]; !ok {
+			resp["success"] = true
+		}
+	}
+	c.WriteJSON(resp)
+}
+
+// errorCode maps an error to an errno-style code (ENOENT, EACCES, ...)
+func errorCode(err error) string {
+	var invalid *validationError
+	var errno syscall.Errno
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &invalid):
+		return "EVALIDATION"
+	case errors.Is(err, context.Canceled):
+		return "ECANCELED"
+	case errors.Is(err, errUploadTooLarge):
+		return "EFBIG"
+	case errors.Is(err, errNoLines):
+		return "EINVAL"
+	case errors.As(err, &errno):
+		if name := unix.ErrnoName(errno); name != "" {
+			return name
+		}
+	case errors.Is(err, fs.ErrNotExist):
+		return "ENOENT"
+	case errors.Is(err, fs.ErrPermission):
+		return "EACCES"
+	case errors.Is(err, fs.ErrExist):
+		return "EEXIST"
+	}
+	return "EIO"
+}
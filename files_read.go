@@ -0,0 +1,492 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
+)
+
+// ==================== LARGE FILE READS ====================
+// read and cat refuse files above READ_MAX_BYTES instead of loading them
+// whole; clients page through big files by byte range (data.offset/length)
+// or by line (data.lines) and follow logs with the tail action.
+
+const (
+	defaultReadMaxBytes = 64 << 20 // Whole-file reads, override with READ_MAX_BYTES
+	defaultReadChunk    = 1 << 20  // Ranged reads without data.length
+	maxReadChunk        = 16 << 20 // Per ranged read or line page
+	defaultReadLines    = 1000
+	maxReadLines        = 10000
+	maxLineBytes        = 64 << 10 // Longer lines are cut and flagged
+	encodingSniffBytes  = 8000
+	defaultTailLines    = 50
+	tailPollInterval    = 500 * time.Millisecond
+	tailMaxChunk        = 256 << 10 // Per tail_data event
+)
+
+// fileEncoding describes the text encoding sniffed from the start of a file
+type fileEncoding struct {
+	Name   string `json:"encoding"` // utf-8, utf-16le, utf-16be, windows-1252 or binary
+	BOM    bool   `json:"bom,omitempty"`
+	Binary bool   `json:"binary"`
+}
+
+// detectEncoding guesses the encoding of sample. UTF-16 is recognised by its
+// BOM or by the NUL bytes of ASCII text; invalid UTF-8 without control
+// characters is taken to be Windows-1252 (a superset of Latin-1).
+func detectEncoding(sample []byte) fileEncoding {
+	switch {
+	case bytes.HasPrefix(sample, []byte{0xEF, 0xBB, 0xBF}):
+		return fileEncoding{Name: "utf-8", BOM: true}
+	case bytes.HasPrefix(sample, []byte{0xFF, 0xFE}):
+		return fileEncoding{Name: "utf-16le", BOM: true}
+	case bytes.HasPrefix(sample, []byte{0xFE, 0xFF}):
+		return fileEncoding{Name: "utf-16be", BOM: true}
+	}
+	if len(sample) > encodingSniffBytes {
+		sample = sample[:encodingSniffBytes]
+	}
+
+	if bytes.IndexByte(sample, 0) >= 0 {
+		var even, odd int
+		for i, b := range sample {
+			if b == 0 {
+				if i%2 == 0 {
+					even++
+				} else {
+					odd++
+				}
+			}
+		}
+		half := len(sample) / 2
+		switch {
+		case half > 0 && odd > half*3/4 && even < half/10:
+			return fileEncoding{Name: "utf-16le"}
+		case half > 0 && even > half*3/4 && odd < half/10:
+			return fileEncoding{Name: "utf-16be"}
+		}
+		return fileEncoding{Name: "binary", Binary: true}
+	}
+
+	// A multi-byte character may be cut at the end of the sample
+	valid := sample
+	for i := 0; i < utf8.UTFMax && len(valid) > 0 && !utf8.Valid(valid); i++ {
+		valid = valid[:len(valid)-1]
+	}
+	if utf8.Valid(valid) && len(sample)-len(valid) < utf8.UTFMax {
+		return fileEncoding{Name: "utf-8"}
+	}
+
+	var control int
+	for _, b := range sample {
+		if b < 0x20 && b != '\t' && b != '\n' && b != '\r' && b != '\f' && b != '\v' && b != 0x1b {
+			control++
+		}
+	}
+	if control*20 < len(sample) {
+		return fileEncoding{Name: "windows-1252"}
+	}
+	return fileEncoding{Name: "binary", Binary: true}
+}
+
+// sniffFileEncoding reads the start of an open file without moving its offset
+func sniffFileEncoding(f *os.File) fileEncoding {
+	buf := make([]byte, encodingSniffBytes)
+	n, _ := f.ReadAt(buf, 0)
+	return detectEncoding(buf[:n])
+}
+
+// decodeText converts data in enc to UTF-8
+func decodeText(data []byte, enc fileEncoding) (string, error) {
+	switch enc.Name {
+	case "utf-8":
+		return string(bytes.TrimPrefix(data, []byte{0xEF, 0xBB, 0xBF})), nil
+	case "utf-16le":
+		out, err := unicode.UTF16(unicode.LittleEndian, unicode.UseBOM).NewDecoder().Bytes(data)
+		return string(out), err
+	case "utf-16be":
+		out, err := unicode.UTF16(unicode.BigEndian, unicode.UseBOM).NewDecoder().Bytes(data)
+		return string(out), err
+	case "windows-1252":
+		out, err := charmap.Windows1252.NewDecoder().Bytes(data)
+		return string(out), err
+	}
+	return "", errors.New("binary file")
+}
+
+var errNoLines = errors.New("can't be paged by line, read it by offset and length instead")
+
+// lineEncoding reports whether lines can be split on '\n' bytes
+func lineEncoding(enc fileEncoding) error {
+	switch enc.Name {
+	case "utf-8", "windows-1252":
+		return nil
+	}
+	return fmt.Errorf("%s file %w", enc.Name, errNoLines)
+}
+
+// readWholeFile reads path for the plain read and cat actions, refusing
+// files larger than READ_MAX_BYTES
+func readWholeFile(path string) ([]byte, os.FileInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	if info.IsDir() {
+		return nil, nil, fmt.Errorf("%s is a directory", path)
+	}
+	limit := getSettingInt("READ_MAX_BYTES", defaultReadMaxBytes)
+	if limit > 0 && info.Size() > limit {
+		return nil, info, fmt.Errorf("file is %d bytes, page through it with offset/length or lines: %w", info.Size(), syscall.EFBIG)
+	}
+	data, err := io.ReadAll(f)
+	return data, info, err
+}
+
+// readRange reads up to length bytes at offset
+func readRange(path string, offset, length int64) (map[string]interface{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, fmt.Errorf("%s is a directory", path)
+	}
+	if offset < 0 {
+		offset += info.Size() // Negative offsets count from the end
+		if offset < 0 {
+			offset = 0
+		}
+	}
+	if length <= 0 {
+		length = defaultReadChunk
+	}
+	if length > maxReadChunk {
+		length = maxReadChunk
+	}
+	if remaining := info.Size() - offset; remaining < length {
+		length = remaining
+	}
+	if length < 0 {
+		length = 0
+	}
+
+	buf := make([]byte, length)
+	n, err := f.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	enc := sniffFileEncoding(f)
+	return map[string]interface{}{
+		"offset":   offset,
+		"length":   n,
+		"size":     info.Size(),
+		"eof":      offset+int64(n) >= info.Size(),
+		"data":     buf[:n], // Base64 when serialized
+		"encoding": enc.Name,
+		"bom":      enc.BOM,
+		"binary":   enc.Binary,
+	}, nil
+}
+
+// linePage is one page of lines returned by readLines
+type linePage struct {
+	Lines      []string `json:"lines"`
+	Line       int64    `json:"line,omitempty"` // Number of the first line, 0 when paging from the end
+	Cursor     int64    `json:"cursor"`         // Byte offset of the first line
+	NextCursor int64    `json:"nextCursor"`     // Pass back as data.cursor for the next page
+	Truncated  []int    `json:"truncated,omitempty"`
+	EOF        bool     `json:"eof"`
+	Size       int64    `json:"size"`
+	fileEncoding
+}
+
+// readLines returns count lines starting at line (1-based) or, when cursor
+// is set, at that byte offset. A negative line returns the last -line lines.
+func readLines(path string, line, cursor int64, count int) (*linePage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, fmt.Errorf("%s is a directory", path)
+	}
+	enc := sniffFileEncoding(f)
+	if err := lineEncoding(enc); err != nil {
+		return nil, err
+	}
+	if count <= 0 {
+		count = defaultReadLines
+	}
+	if count > maxReadLines {
+		count = maxReadLines
+	}
+
+	page := &linePage{Lines: []string{}, Size: info.Size(), fileEncoding: enc}
+	var start int64
+	switch {
+	case line < 0:
+		start = lastLinesOffset(f, info.Size(), int(-line))
+	case cursor > 0:
+		start = cursor
+		page.Line = line
+	default:
+		if line == 0 {
+			line = 1
+		}
+		if start, err = skipLines(f, 0, line-1); err != nil {
+			return nil, err
+		}
+		page.Line = line
+	}
+	page.Cursor = start
+
+	r := io.NewSectionReader(f, start, info.Size()-start)
+	buf := make([]byte, 0, 64*1024)
+	chunk := make([]byte, 64*1024)
+	pos := start
+	var read int64
+	for len(page.Lines) < count && read < maxReadChunk {
+		n, rerr := r.Read(chunk)
+		buf = append(buf, chunk[:n]...)
+		read += int64(n)
+		for len(page.Lines) < count {
+			i := bytes.IndexByte(buf, '\n')
+			if i < 0 && rerr == nil && len(buf) <= maxLineBytes {
+				break // Need more data
+			}
+			lineLen := i
+			if i < 0 {
+				lineLen = len(buf)
+				if rerr != nil && lineLen == 0 {
+					break
+				}
+			}
+			text := buf[:lineLen]
+			cut := false
+			if len(text) > maxLineBytes {
+				text, cut = text[:maxLineBytes], true
+			}
+			decoded, _ := decodeText(bytes.TrimSuffix(text, []byte("\r")), enc)
+			if cut {
+				page.Truncated = append(page.Truncated, len(page.Lines))
+			}
+			page.Lines = append(page.Lines, decoded)
+			if i < 0 {
+				pos += int64(len(buf))
+				buf = buf[:0]
+				if cut && rerr == nil {
+					// Skip the rest of an overlong line
+					skipped, err := skipLines(f, pos, 1)
+					if err != nil {
+						return nil, err
+					}
+					r = io.NewSectionReader(f, skipped, info.Size()-skipped)
+					pos = skipped
+				}
+				break
+			}
+			pos += int64(i + 1)
+			buf = buf[i+1:]
+		}
+		if rerr != nil {
+			break
+		}
+	}
+	page.NextCursor = pos
+	page.EOF = pos >= info.Size()
+	return page, nil
+}
+
+// skipLines returns the offset just past n newlines after pos, or the end of
+// the file if it has fewer lines
+func skipLines(f *os.File, pos, n int64) (int64, error) {
+	chunk := make([]byte, 64*1024)
+	for n > 0 {
+		read, err := f.ReadAt(chunk, pos)
+		data := chunk[:read]
+		for n > 0 {
+			i := bytes.IndexByte(data, '\n')
+			if i < 0 {
+				break
+			}
+			n--
+			pos += int64(i + 1)
+			data = data[i+1:]
+		}
+		if n > 0 {
+			pos += int64(len(data))
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return pos, nil
+}
+
+// lastLinesOffset finds where the last n lines of a file start, reading
+// backwards at most maxReadChunk bytes
+func lastLinesOffset(f *os.File, size int64, n int) int64 {
+	end := size
+	last := make([]byte, 1)
+	if end > 0 {
+		if _, err := f.ReadAt(last, end-1); err == nil && last[0] == '\n' {
+			end-- // The final newline doesn't start a line
+		}
+	}
+	chunk := make([]byte, 64*1024)
+	pos := end
+	for pos > 0 && size-pos < maxReadChunk {
+		step := int64(len(chunk))
+		if pos < step {
+			step = pos
+		}
+		pos -= step
+		read, err := f.ReadAt(chunk[:step], pos)
+		if err != nil && err != io.EOF {
+			return pos
+		}
+		data := chunk[:read]
+		for i := len(data) - 1; i >= 0; i-- {
+			if data[i] == '\n' {
+				n--
+				if n == 0 {
+					return pos + int64(i) + 1
+				}
+			}
+		}
+	}
+	return pos
+}
+
+// tailFile streams the last lines of path and then everything appended to
+// it, like tail -F: when the file is replaced (log rotation) or truncated
+// the new content is followed from its start.
+func tailFile(job *fileJob, lines int, send func(event string, data map[string]interface{})) error {
+	f, err := os.Open(job.Path)
+	if err != nil {
+		return err
+	}
+	defer func() { f.Close() }()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", job.Path)
+	}
+	enc := sniffFileEncoding(f)
+	if info.Size() > 0 {
+		if err := lineEncoding(enc); err != nil {
+			return err
+		}
+	}
+
+	pos := info.Size()
+	if lines > 0 {
+		pos = lastLinesOffset(f, info.Size(), lines)
+	}
+	var pending []byte // Incomplete UTF-8 sequence held for the next read
+
+	// flush sends everything between pos and the end of f
+	flush := func() error {
+		for {
+			buf := make([]byte, tailMaxChunk)
+			n, err := f.ReadAt(buf, pos)
+			if n > 0 {
+				offset := pos
+				pos += int64(n)
+				atomic.AddInt64(&job.Done, int64(n))
+				data := append(pending, buf[:n]...)
+				pending = nil
+				if enc.Name == "utf-8" {
+					keep := len(data)
+					for keep > 0 && len(data)-keep < utf8.UTFMax-1 && !utf8.Valid(data[:keep]) {
+						keep--
+					}
+					if keep > 0 && utf8.Valid(data[:keep]) {
+						pending = append([]byte(nil), data[keep:]...)
+						data = data[:keep]
+					}
+				}
+				text, _ := decodeText(data, enc)
+				send("tail_data", map[string]interface{}{"text": text, "offset": offset, "size": pos})
+			}
+			if err == io.EOF || n < tailMaxChunk {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(tailPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-job.ctx.Done():
+			return nil // Cancelled by the client or the connection closing
+		case <-ticker.C:
+		}
+
+		current, err := os.Stat(job.Path)
+		if err != nil {
+			continue // Rotated away and not recreated yet
+		}
+		opened, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		if !os.SameFile(current, opened) {
+			// Drain what was written to the old file, then switch over
+			if err := flush(); err != nil {
+				return err
+			}
+			next, err := os.Open(job.Path)
+			if err != nil {
+				continue
+			}
+			f.Close()
+			f, pos, pending = next, 0, nil
+			enc = sniffFileEncoding(f)
+			send("tail_rotated", map[string]interface{}{"reason": "replaced"})
+		} else if opened.Size() < pos {
+			pos, pending = 0, nil
+			send("tail_rotated", map[string]interface{}{"reason": "truncated"})
+		}
+		if err := flush(); err != nil {
+			return err
+		}
+	}
+}
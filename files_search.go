@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ==================== RECURSIVE FILE SEARCH ====================
+// The "search" action walks a tree matching names (glob or regex) and
+// optionally file contents, streaming hits back as search_results events.
+
+const (
+	defaultSearchMaxFileSize = 10 << 20 // Skip content grep on files above 10 MB
+	defaultSearchMaxResults  = 1000
+	searchMaxLineMatches     = 20 // Per file
+	searchMaxLineLength      = 200
+	searchBatchSize          = 50
+	searchBatchInterval      = 300 * time.Millisecond
+)
+
+// Pseudo filesystems that are never useful to search and can hang on read
+var searchSkipDirs = map[string]bool{"/proc": true, "/sys": true, "/dev": true}
+
+type searchOptions struct {
+	Root          string
+	Name          *regexp.Regexp // nil matches every name
+	Content       *regexp.Regexp // nil disables content grep
+	MaxFileSize   int64
+	MaxResults    int
+	IncludeHidden bool
+	UseGitignore  bool
+	Excludes      []string // gitignore-style patterns relative to Root
+}
+
+type searchLineMatch struct {
+	Line int    `json:"line"`
+	Text string `json:"text"`
+}
+
+type searchHit struct {
+	Path    string            `json:"path"`
+	Name    string            `json:"name"`
+	IsDir   bool              `json:"isDir"`
+	Size    int64             `json:"size"`
+	Matches []searchLineMatch `json:"matches,omitempty"`
+}
+
+// parseSearchOptions builds options from the request data:
+// name (glob), regex (name regex), content, contentRegex, caseSensitive,
+// maxFileSize, maxResults, includeHidden, gitignore (default true), excludes.
+func parseSearchOptions(root string, data map[string]interface{}) (*searchOptions, error) {
+	opts := &searchOptions{
+		Root:         root,
+		MaxFileSize:  defaultSearchMaxFileSize,
+		MaxResults:   defaultSearchMaxResults,
+		UseGitignore: true,
+	}
+	caseSensitive, _ := data["caseSensitive"].(bool)
+	flags := "(?i)"
+	if caseSensitive {
+		flags = ""
+	}
+
+	if glob, _ := data["name"].(string); glob != "" {
+		re, err := regexp.Compile(flags + "^" + globToRegexp(glob) + "$")
+		if err != nil {
+			return nil, err
+		}
+		opts.Name = re
+	} else if expr, _ := data["regex"].(string); expr != "" {
+		re, err := regexp.Compile(flags + expr)
+		if err != nil {
+			return nil, err
+		}
+		opts.Name = re
+	}
+
+	if content, _ := data["content"].(string); content != "" {
+		expr := regexp.QuoteMeta(content)
+		if isRegex, _ := data["contentRegex"].(bool); isRegex {
+			expr = content
+		}
+		re, err := regexp.Compile(flags + expr)
+		if err != nil {
+			return nil, err
+		}
+		opts.Content = re
+	}
+
+	if v, ok := data["maxFileSize"].(float64); ok && v > 0 {
+		opts.MaxFileSize = int64(v)
+	}
+	if v, ok := data["maxResults"].(float64); ok && v > 0 {
+		opts.MaxResults = int(v)
+	}
+	opts.IncludeHidden, _ = data["includeHidden"].(bool)
+	if v, ok := data["gitignore"].(bool); ok {
+		opts.UseGitignore = v
+	}
+	if list, ok := data["excludes"].([]interface{}); ok {
+		for _, e := range list {
+			if s, ok := e.(string); ok {
+				opts.Excludes = append(opts.Excludes, s)
+			}
+		}
+	}
+	return opts, nil
+}
+
+// runSearch walks the tree, calling emit with batches of hits. It returns the
+// number of entries scanned and whether the result limit was hit.
+func runSearch(job *fileJob, opts *searchOptions, emit func([]searchHit)) (int64, bool, error) {
+	ignore := &ignoreMatcher{}
+	ignore.add(opts.Root, opts.Excludes)
+
+	var batch []searchHit
+	var scanned int64
+	matched := 0
+	lastFlush := time.Now()
+	flush := func() {
+		if len(batch) > 0 {
+			emit(batch)
+			batch = nil
+		}
+		lastFlush = time.Now()
+	}
+
+	err := filepath.WalkDir(opts.Root, func(path string, d fs.DirEntry, err error) error {
+		if ctxErr := job.ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if err != nil {
+			// Unreadable directories are skipped rather than aborting the search
+			if d != nil && d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if path != opts.Root {
+			if searchSkipDirs[path] && d.IsDir() {
+				return fs.SkipDir
+			}
+			if !opts.IncludeHidden && strings.HasPrefix(d.Name(), ".") {
+				if d.IsDir() {
+					return fs.SkipDir
+				}
+				return nil
+			}
+			if ignore.match(path, d.IsDir()) {
+				if d.IsDir() {
+					return fs.SkipDir
+				}
+				return nil
+			}
+		}
+		if d.IsDir() && opts.UseGitignore {
+			ignore.loadGitignore(path)
+		}
+
+		atomic.AddInt64(&job.Done, 1)
+		scanned++
+
+		if opts.Name != nil && !opts.Name.MatchString(d.Name()) {
+			return nil
+		}
+
+		hit := searchHit{Path: path, Name: d.Name(), IsDir: d.IsDir()}
+		if info, err := d.Info(); err == nil {
+			hit.Size = info.Size()
+		}
+
+		if opts.Content != nil {
+			if !d.Type().IsRegular() || hit.Size > opts.MaxFileSize {
+				return nil
+			}
+			hit.Matches = grepFile(path, opts.Content)
+			if len(hit.Matches) == 0 {
+				return nil
+			}
+		}
+
+		batch = append(batch, hit)
+		matched++
+		if matched >= opts.MaxResults {
+			return fs.SkipAll
+		}
+		if len(batch) >= searchBatchSize || time.Since(lastFlush) > searchBatchInterval {
+			flush()
+		}
+		return nil
+	})
+	flush()
+	return scanned, matched >= opts.MaxResults, err
+}
+
+// grepFile returns matching lines, skipping files that look binary
+func grepFile(path string, re *regexp.Regexp) []searchLineMatch {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	br := bufio.NewReaderSize(f, 64*1024)
+	if head, _ := br.Peek(8000); bytes.IndexByte(head, 0) >= 0 {
+		return nil
+	}
+
+	var matches []searchLineMatch
+	lineNo := 0
+	for {
+		line, err := br.ReadSlice('\n')
+		if len(line) > 0 {
+			lineNo++
+			if re.Match(line) {
+				text := strings.TrimRight(string(line), "\r\n")
+				if len(text) > searchMaxLineLength {
+					text = text[:searchMaxLineLength]
+				}
+				matches = append(matches, searchLineMatch{Line: lineNo, Text: text})
+				if len(matches) >= searchMaxLineMatches {
+					return matches
+				}
+			}
+		}
+		// Overlong line: only its first buffer is matched, skip the rest
+		for err == bufio.ErrBufferFull {
+			_, err = br.ReadSlice('\n')
+		}
+		if err != nil {
+			return matches
+		}
+	}
+}
+
+// ==================== GITIGNORE-STYLE MATCHING ====================
+
+type ignoreRule struct {
+	base    string // Directory the pattern is relative to
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+	rooted  bool // Pattern contains a slash, so it matches the relative path, not the name
+}
+
+type ignoreMatcher struct {
+	rules []ignoreRule
+}
+
+func (m *ignoreMatcher) add(base string, patterns []string) {
+	for _, p := range patterns {
+		p = strings.TrimRight(p, " \t\r")
+		if p == "" || strings.HasPrefix(p, "#") {
+			continue
+		}
+		rule := ignoreRule{base: base}
+		if strings.HasPrefix(p, "!") {
+			rule.negate = true
+			p = p[1:]
+		}
+		if strings.HasSuffix(p, "/") {
+			rule.dirOnly = true
+			p = strings.TrimSuffix(p, "/")
+		}
+		if strings.Contains(p, "/") {
+			rule.rooted = true
+			p = strings.TrimPrefix(p, "/")
+		}
+		re, err := regexp.Compile("^" + globToRegexp(p) + "$")
+		if err != nil {
+			continue
+		}
+		rule.re = re
+		m.rules = append(m.rules, rule)
+	}
+}
+
+func (m *ignoreMatcher) loadGitignore(dir string) {
+	data, err := os.ReadFile(filepath.Join(dir, ".gitignore"))
+	if err != nil {
+		return
+	}
+	m.add(dir, strings.Split(string(data), "\n"))
+}
+
+// match reports whether path is excluded; the last matching rule wins
+func (m *ignoreMatcher) match(path string, isDir bool) bool {
+	ignored := false
+	for _, rule := range m.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		rel, err := filepath.Rel(rule.base, path)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		subject := filepath.Base(path)
+		if rule.rooted {
+			subject = filepath.ToSlash(rel)
+		}
+		if rule.re.MatchString(subject) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+// globToRegexp converts a glob ("*", "?", "[...]", "**") into a regexp body.
+// "*" stays within one path segment while "**" crosses segments.
+func globToRegexp(glob string) string {
+	var sb strings.Builder
+	for i := 0; i < len(glob); i++ {
+		ch := glob[i]
+		switch ch {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				i++
+				if i+1 < len(glob) && glob[i+1] == '/' {
+					// "**/" matches zero or more directories
+					i++
+					sb.WriteString("(?:.*/)?")
+				} else {
+					sb.WriteString(".*")
+				}
+			} else {
+				sb.WriteString("[^/]*")
+			}
+		case '?':
+			sb.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				sb.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				sb.WriteString(regexp.QuoteMeta(string(glob[i])))
+			}
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+	return sb.String()
+}
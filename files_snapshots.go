@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// ==================== PRE-CHANGE SNAPSHOTS ====================
+// Before rm, rename or an overwriting upload/write, the current contents are
+// saved as file versions so anything lost through the file manager can be
+// restored from history. Limits keep large trees from flooding the store.
+
+const (
+	defaultSnapshotMaxFileBytes  = 5 << 20  // Override with SNAPSHOT_MAX_FILE_BYTES (0 disables snapshots)
+	defaultSnapshotMaxTotalBytes = 50 << 20 // Per operation, override with SNAPSHOT_MAX_TOTAL_BYTES
+	defaultSnapshotMaxFiles      = 500      // Per operation, override with SNAPSHOT_MAX_FILES
+)
+
+type fileSnapshot struct {
+	Path string
+	Data []byte
+}
+
+// snapshotBeforeChange reads the regular files at or under path that fit the
+// snapshot limits. Symlinks are not followed.
+func snapshotBeforeChange(path string) []fileSnapshot {
+	maxFile := getSettingInt("SNAPSHOT_MAX_FILE_BYTES", defaultSnapshotMaxFileBytes)
+	if maxFile <= 0 {
+		return nil
+	}
+	maxTotal := getSettingInt("SNAPSHOT_MAX_TOTAL_BYTES", defaultSnapshotMaxTotalBytes)
+	maxFiles := int(getSettingInt("SNAPSHOT_MAX_FILES", defaultSnapshotMaxFiles))
+
+	var snaps []fileSnapshot
+	var total int64
+	filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if d != nil && d.IsDir() && p != path {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if searchSkipDirs[p] && d.IsDir() {
+			return fs.SkipDir
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || info.Size() > maxFile || total+info.Size() > maxTotal {
+			return nil
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return nil
+		}
+		snaps = append(snaps, fileSnapshot{Path: p, Data: data})
+		total += int64(len(data))
+		if len(snaps) >= maxFiles {
+			return fs.SkipAll
+		}
+		return nil
+	})
+	return snaps
+}
+
+// saveSnapshots stores captured contents as versions linked to the log entry
+// of the operation that replaced or removed them
+func saveSnapshots(logID uint, reason string, snaps []fileSnapshot) {
+	for _, s := range snaps {
+		if _, err := saveFileVersion(logID, s.Path, reason, s.Data); err != nil {
+			log.Println("versions: failed to snapshot", s.Path, err)
+		}
+	}
+}
+
+// snapshotFileBeforeChange snapshots path only when it is an existing regular
+// file, for targets that are about to be overwritten
+func snapshotFileBeforeChange(path string) []fileSnapshot {
+	if info, err := os.Lstat(path); err != nil || !info.Mode().IsRegular() {
+		return nil
+	}
+	return snapshotBeforeChange(path)
+}
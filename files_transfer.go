@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ==================== STREAMING FILE TRANSFER ====================
+// HTTP endpoints that move file contents without loading them into memory,
+// as opposed to the base64 read/write actions on the files WebSocket.
+
+const (
+	defaultUploadMaxBytes = 10 << 30 // 10 GB, override with UPLOAD_MAX_BYTES setting
+	uploadVersionMaxBytes = 5 << 20  // Only snapshot uploads up to 5 MB into FileVersion
+)
+
+var errUploadTooLarge = errors.New("upload exceeds size limit")
+
+// sectionReadCloser closes the underlying file once fasthttp has sent the body
+type sectionReadCloser struct {
+	*io.SectionReader
+	f *os.File
+}
+
+func (s *sectionReadCloser) Close() error {
+	return s.f.Close()
+}
+
+// DownloadFile streams a file with Range and ETag support.
+// GET /api/files/download?path=/var/log/syslog
+func DownloadFile(c *fiber.Ctx) error {
+	if c.Query("path") == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "path required"})
+	}
+	cleanPath := filepath.Clean(c.Query("path"))
+
+	f, err := os.Open(cleanPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": "File not found"})
+		}
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": err.Error()})
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": err.Error()})
+	}
+	if info.IsDir() {
+		f.Close()
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Path is a directory"})
+	}
+
+	size := info.Size()
+	etag := fmt.Sprintf(`"%x-%x"`, size, info.ModTime().UnixNano())
+	c.Set("ETag", etag)
+	c.Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+	c.Set("Accept-Ranges", "bytes")
+
+	if etagMatches(c.Get("If-None-Match"), etag) {
+		f.Close()
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+
+	start, length := int64(0), size
+	rangeHeader := c.Get("Range")
+	// If-Range: only honour the range when the client's copy is still current
+	if ifRange := c.Get("If-Range"); ifRange != "" && ifRange != etag {
+		rangeHeader = ""
+	}
+	if rangeHeader != "" {
+		s, l, err := parseByteRange(rangeHeader, size)
+		if err != nil {
+			f.Close()
+			c.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			return c.Status(fiber.StatusRequestedRangeNotSatisfiable).JSON(fiber.Map{"message": err.Error()})
+		}
+		if l >= 0 {
+			start, length = s, l
+			c.Status(fiber.StatusPartialContent)
+			c.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, size))
+		}
+	}
+
+	contentType := mime.TypeByExtension(filepath.Ext(cleanPath))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	c.Set("Content-Type", contentType)
+	c.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(cleanPath)))
+
+	// Logged only now that content is actually going out
+	claims := c.Locals("user").(jwt.MapClaims)
+	userIdFloat, _ := claims["iss"].(float64)
+	auditRead(uint(userIdFloat), cleanPath, length, nil)
+	return c.SendStream(&sectionReadCloser{io.NewSectionReader(f, start, length), f}, int(length))
+}
+
+func etagMatches(header, etag string) bool {
+	if header == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// parseByteRange parses a single "bytes=" range. Multi-range requests return
+// length -1 so the caller falls back to sending the whole file.
+func parseByteRange(header string, size int64) (int64, int64, error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return 0, 0, errors.New("invalid range unit")
+	}
+	if strings.Contains(spec, ",") {
+		return 0, -1, nil
+	}
+	startStr, endStr, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return 0, 0, errors.New("invalid range")
+	}
+
+	if startStr == "" {
+		// Suffix range: last N bytes
+		n, err := strconv.ParseInt(endStr, 10, 64)
+		if err != nil || n <= 0 || size == 0 {
+			return 0, 0, errors.New("invalid range")
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, nil
+	}
+
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, errors.New("range not satisfiable")
+	}
+	end := size - 1
+	if endStr != "" {
+		end, err = strconv.ParseInt(endStr, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, errors.New("invalid range")
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end - start + 1, nil
+}
+
+// UploadFile streams the request body to disk via a temp file and atomic rename.
+// PUT/POST /api/files/upload?path=/target/file (raw body)
+// POST /api/files/upload?path=/target/dir (multipart/form-data, field "file")
+// Add overwrite=false to refuse replacing an existing file.
+func UploadFile(c *fiber.Ctx) error {
+	claims := c.Locals("user").(jwt.MapClaims)
+	userIdFloat, _ := claims["iss"].(float64)
+	userID := uint(userIdFloat)
+
+	if c.Query("path") == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "path required"})
+	}
+	target := filepath.Clean(c.Query("path"))
+	overwrite := c.Query("overwrite") != "false"
+
+	maxBytes := getSettingInt("UPLOAD_MAX_BYTES", defaultUploadMaxBytes)
+	if cl := c.Request().Header.ContentLength(); cl > 0 && int64(cl) > maxBytes {
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{"message": errUploadTooLarge.Error()})
+	}
+
+	body := requestBodyReader(c)
+	mediaType, params, _ := mime.ParseMediaType(c.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "multipart body has no file field"})
+			}
+			if part.FormName() == "file" && part.FileName() != "" {
+				target = filepath.Join(target, filepath.Base(part.FileName()))
+				body = part
+				break
+			}
+		}
+	}
+
+	var previous []fileSnapshot
+	if overwrite {
+		previous = snapshotFileBeforeChange(target)
+	}
+	written, err := streamToFile(target, body, maxBytes, overwrite)
+	if err != nil {
+		auditFile(userID, "FILE_UPLOAD", target, "", written, "Upload", err)
+		switch {
+		case errors.Is(err, errUploadTooLarge):
+			return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{"message": err.Error()})
+		case errors.Is(err, os.ErrExist):
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"message": "File already exists"})
+		default:
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Upload failed: " + err.Error()})
+		}
+	}
+
+	recordUpload(userID, target, written, previous)
+
+	return c.JSON(fiber.Map{"message": "Upload complete", "path": target, "size": written})
+}
+
+// requestBodyReader returns the streamed request body, or the buffered one for small requests
+func requestBodyReader(c *fiber.Ctx) io.Reader {
+	if body := c.Context().RequestBodyStream(); body != nil {
+		return body
+	}
+	return bytes.NewReader(c.Body())
+}
+
+// recordUpload logs a completed upload and snapshots small files like editor
+// saves. previous holds the contents the upload replaced, if any.
+func recordUpload(userID uint, target string, size int64, previous []fileSnapshot) {
+	logEntry := auditFile(userID, "FILE_UPLOAD", target, "", size, fmt.Sprintf("Uploaded %d bytes", size), nil)
+	saveSnapshots(logEntry.ID, "pre_overwrite", previous)
+
+	if size <= uploadVersionMaxBytes {
+		if data, err := os.ReadFile(target); err == nil {
+			saveFileVersion(logEntry.ID, target, "upload", data)
+		}
+	}
+}
+
+// streamToFile copies r into a temp file next to target and renames it into
+// place, so readers never observe a partially written file.
+func streamToFile(target string, r io.Reader, maxBytes int64, overwrite bool) (int64, error) {
+	if _, err := os.Stat(target); err == nil && !overwrite {
+		return 0, os.ErrExist
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(resolveTarget(target)), "."+filepath.Base(target)+".upload-*")
+	if err != nil {
+		return 0, err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	written, err := io.Copy(tmp, io.LimitReader(r, maxBytes+1))
+	if err != nil {
+		return 0, err
+	}
+	if written > maxBytes {
+		return 0, errUploadTooLarge
+	}
+	if err := tmp.Sync(); err != nil {
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	if err := placeFile(tmp.Name(), target); err != nil {
+		return 0, err
+	}
+	committed = true
+	return written, nil
+}
+
+// placeFile renames a fully written staging file over target, keeping the
+// mode, owner and xattrs of the file it replaces (0644 for new files). A
+// symlink at target is followed, as atomicWriteFile does.
+func placeFile(staged, target string) error {
+	target = resolveTarget(target)
+	info, err := os.Stat(target)
+	switch {
+	case err == nil && info.IsDir():
+		return fmt.Errorf("%s is a directory", target)
+	case err == nil:
+		if err := copyFileAttrs(info, target, staged); err != nil {
+			if !errors.Is(err, syscall.EPERM) {
+				return err
+			}
+			// Can't keep the owner without root; keep at least the mode
+			if err := os.Chmod(staged, info.Mode().Perm()); err != nil {
+				return err
+			}
+		}
+	default:
+		if err := os.Chmod(staged, 0644); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(staged, target); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(target))
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ==================== TRASH ====================
+// rm moves items into a per-user trash folder (trash/<user id>/) instead of
+// deleting them, so they can be restored until purged.
+
+const (
+	defaultTrashRetentionDays = 30
+	defaultTrashMaxBytes      = 10 << 30 // Per user, override with TRASH_MAX_BYTES
+)
+
+var trashRoot string
+
+func initTrash() {
+	var err error
+	if trashRoot, err = filepath.Abs("trash"); err != nil {
+		log.Fatal("failed to resolve trash directory")
+	}
+	go trashJanitor()
+}
+
+// moveToTrash moves path into the user's trash and records it
+func moveToTrash(userID uint, path string) (*TrashItem, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	// The trash itself (or anything containing it) can't be moved into the trash
+	if rel, err := filepath.Rel(path, trashRoot); err == nil && !strings.HasPrefix(rel, "..") {
+		return nil, errors.New("refusing to trash " + path)
+	}
+	if strings.HasPrefix(path, trashRoot+string(os.PathSeparator)) {
+		return nil, errors.New("item is already in the trash, use purge")
+	}
+
+	userDir := filepath.Join(trashRoot, strconv.Itoa(int(userID)))
+	if err := os.MkdirAll(userDir, 0700); err != nil {
+		return nil, err
+	}
+
+	size := info.Size()
+	if info.IsDir() {
+		size = treeSize(path)
+	}
+	item := TrashItem{
+		UserID:       userID,
+		OriginalPath: path,
+		IsDir:        info.IsDir(),
+		Size:         size,
+		TrashedAt:    time.Now(),
+	}
+	if err := DB.Create(&item).Error; err != nil {
+		return nil, err
+	}
+
+	item.TrashPath = filepath.Join(userDir, fmt.Sprintf("%d-%s", item.ID, filepath.Base(path)))
+	if err := movePath(context.Background(), path, item.TrashPath, nil); err != nil {
+		DB.Delete(&item)
+		return nil, err
+	}
+	DB.Model(&item).Update("trash_path", item.TrashPath)
+	return &item, nil
+}
+
+// restoreFromTrash moves an item back to its original path, or to dest if given
+func restoreFromTrash(item *TrashItem, dest string) error {
+	if dest == "" {
+		dest = item.OriginalPath
+	}
+	if _, err := os.Lstat(dest); err == nil {
+		return fmt.Errorf("%s already exists", dest)
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	if err := movePath(context.Background(), item.TrashPath, dest, nil); err != nil {
+		return err
+	}
+	return DB.Delete(item).Error
+}
+
+func purgeTrashItem(item *TrashItem) error {
+	if err := os.RemoveAll(item.TrashPath); err != nil {
+		return err
+	}
+	return DB.Delete(item).Error
+}
+
+// trashJanitor purges items past TRASH_RETENTION_DAYS and trims each user's
+// trash to TRASH_MAX_BYTES, oldest first
+func trashJanitor() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		days := getSettingInt("TRASH_RETENTION_DAYS", defaultTrashRetentionDays)
+		var expired []TrashItem
+		DB.Where("trashed_at < ?", time.Now().AddDate(0, 0, -int(days))).Find(&expired)
+		for i := range expired {
+			if err := purgeTrashItem(&expired[i]); err != nil {
+				log.Println("trash: failed to purge", expired[i].TrashPath, err)
+			}
+		}
+
+		maxBytes := getSettingInt("TRASH_MAX_BYTES", defaultTrashMaxBytes)
+		var usage []struct {
+			UserID uint
+			Total  int64
+		}
+		DB.Model(&TrashItem{}).Select("user_id, SUM(size) AS total").Group("user_id").Having("SUM(size) > ?", maxBytes).Scan(&usage)
+		for _, u := range usage {
+			var items []TrashItem
+			DB.Where("user_id = ?", u.UserID).Order("trashed_at asc").Find(&items)
+			total := u.Total
+			for i := 0; i < len(items) && total > maxBytes; i++ {
+				if err := purgeTrashItem(&items[i]); err == nil {
+					total -= items[i].Size
+				}
+			}
+		}
+		<-ticker.C
+	}
+}
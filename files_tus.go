@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ==================== RESUMABLE UPLOADS (tus 1.0) ====================
+// Implements the tus core protocol plus the creation, expiration, checksum
+// and termination extensions. Chunks are appended to a hidden staging file
+// in the destination directory, which is renamed into place when complete.
+//
+// Upload-Metadata must carry "path" (destination file, or directory when
+// "filename" is also given).
+
+const (
+	tusVersion            = "1.0.0"
+	tusStatusChecksumFail = 460
+	defaultUploadExpiry   = 24 * time.Hour // override with UPLOAD_EXPIRY_HOURS setting
+)
+
+// Serialize PATCH requests per upload so offsets stay consistent
+var tusLocks sync.Map // upload id -> *sync.Mutex
+
+func tusLock(id string) *sync.Mutex {
+	mu, _ := tusLocks.LoadOrStore(id, &sync.Mutex{})
+	return mu.(*sync.Mutex)
+}
+
+// lockTusUpload is tusUpload holding the upload's lock. The lock is only
+// taken once the upload is known to exist, so bogus ids don't leave mutexes
+// behind, and the upload is reloaded under it since it may have moved on
+// (or gone) while this request waited.
+func lockTusUpload(c *fiber.Ctx) (*FileUpload, *sync.Mutex, bool) {
+	upload, ok := tusUpload(c)
+	if !ok {
+		return nil, nil, false
+	}
+	mu := tusLock(upload.ID)
+	mu.Lock()
+	if upload, ok = tusUpload(c); !ok {
+		tusLocks.Delete(c.Params("id"))
+		mu.Unlock()
+		return nil, nil, false
+	}
+	return upload, mu, true
+}
+
+func tusHeaders(c *fiber.Ctx) {
+	c.Set("Tus-Resumable", tusVersion)
+	c.Set("Cache-Control", "no-store")
+}
+
+func tusExpiry() time.Duration {
+	return time.Duration(getSettingInt("UPLOAD_EXPIRY_HOURS", int64(defaultUploadExpiry/time.Hour))) * time.Hour
+}
+
+// tusUpload loads an upload owned by the current user, writing the error response itself
+func tusUpload(c *fiber.Ctx) (*FileUpload, bool) {
+	tusHeaders(c)
+	if c.Get("Tus-Resumable") != tusVersion {
+		c.Set("Tus-Version", tusVersion)
+		c.SendStatus(fiber.StatusPreconditionFailed)
+		return nil, false
+	}
+
+	claims := c.Locals("user").(jwt.MapClaims)
+	userIdFloat, _ := claims["iss"].(float64)
+
+	var upload FileUpload
+	if err := DB.First(&upload, "id = ?", c.Params("id")).Error; err != nil || upload.UserID != uint(userIdFloat) {
+		c.SendStatus(fiber.StatusNotFound)
+		return nil, false
+	}
+	if time.Now().After(upload.ExpiresAt) {
+		c.SendStatus(fiber.StatusGone)
+		return nil, false
+	}
+	return &upload, true
+}
+
+func TusOptions(c *fiber.Ctx) error {
+	tusHeaders(c)
+	c.Set("Tus-Version", tusVersion)
+	c.Set("Tus-Extension", "creation,expiration,checksum,termination")
+	c.Set("Tus-Checksum-Algorithm", "md5,sha1,sha256,sha512")
+	c.Set("Tus-Max-Size", strconv.FormatInt(getSettingInt("UPLOAD_MAX_BYTES", defaultUploadMaxBytes), 10))
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func TusCreate(c *fiber.Ctx) error {
+	tusHeaders(c)
+	if c.Get("Tus-Resumable") != tusVersion {
+		c.Set("Tus-Version", tusVersion)
+		return c.SendStatus(fiber.StatusPreconditionFailed)
+	}
+
+	claims := c.Locals("user").(jwt.MapClaims)
+	userIdFloat, _ := claims["iss"].(float64)
+
+	length, err := strconv.ParseInt(c.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		return c.Status(fiber.StatusBadRequest).SendString("Upload-Length required")
+	}
+	if length > getSettingInt("UPLOAD_MAX_BYTES", defaultUploadMaxBytes) {
+		return c.Status(fiber.StatusRequestEntityTooLarge).SendString(errUploadTooLarge.Error())
+	}
+
+	meta := parseTusMetadata(c.Get("Upload-Metadata"))
+	if meta["path"] == "" {
+		return c.Status(fiber.StatusBadRequest).SendString("Upload-Metadata must include path")
+	}
+	target := filepath.Clean(meta["path"])
+	if name := meta["filename"]; name != "" {
+		target = filepath.Join(target, filepath.Base(name))
+	}
+	if info, err := os.Stat(filepath.Dir(target)); err != nil || !info.IsDir() {
+		return c.Status(fiber.StatusBadRequest).SendString("Destination directory does not exist")
+	}
+
+	idBytes := make([]byte, 16)
+	rand.Read(idBytes)
+	id := hex.EncodeToString(idBytes)
+
+	partPath := filepath.Join(filepath.Dir(resolveTarget(target)), "."+filepath.Base(target)+".tus-"+id)
+	part, err := os.OpenFile(partPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to create upload: " + err.Error())
+	}
+	part.Close()
+
+	upload := FileUpload{
+		ID:        id,
+		UserID:    uint(userIdFloat),
+		Path:      target,
+		PartPath:  partPath,
+		Length:    length,
+		ExpiresAt: time.Now().Add(tusExpiry()),
+		CreatedAt: time.Now(),
+	}
+	if err := DB.Create(&upload).Error; err != nil {
+		os.Remove(partPath)
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to create upload")
+	}
+
+	// Zero-length uploads are complete on creation
+	if length == 0 {
+		if err := finishTusUpload(&upload); err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
+		}
+	}
+
+	c.Set("Location", "/api/files/tus/"+id)
+	c.Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	return c.SendStatus(fiber.StatusCreated)
+}
+
+func TusHead(c *fiber.Ctx) error {
+	upload, ok := tusUpload(c)
+	if !ok {
+		return nil
+	}
+	c.Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	c.Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	return c.SendStatus(fiber.StatusOK)
+}
+
+func TusPatch(c *fiber.Ctx) error {
+	upload, mu, ok := lockTusUpload(c)
+	if !ok {
+		return nil
+	}
+	defer mu.Unlock()
+	if c.Get("Content-Type") != "application/offset+octet-stream" {
+		return c.SendStatus(fiber.StatusUnsupportedMediaType)
+	}
+	offset, err := strconv.ParseInt(c.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset != upload.Offset {
+		return c.SendStatus(fiber.StatusConflict)
+	}
+
+	var hasher hash.Hash
+	var expected []byte
+	if header := c.Get("Upload-Checksum"); header != "" {
+		algo, sum, _ := strings.Cut(header, " ")
+		hasher = newChecksumHash(algo)
+		expected, err = base64.StdEncoding.DecodeString(sum)
+		if hasher == nil || err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Unsupported checksum")
+		}
+	}
+
+	part, err := os.OpenFile(upload.PartPath, os.O_WRONLY, 0600)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString("Upload data missing")
+	}
+	defer part.Close()
+	if _, err := part.Seek(offset, io.SeekStart); err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
+	}
+
+	var w io.Writer = part
+	if hasher != nil {
+		w = io.MultiWriter(part, hasher)
+	}
+	remaining := upload.Length - offset
+	written, copyErr := io.Copy(w, io.LimitReader(requestBodyReader(c), remaining+1))
+	if cl := c.Request().Header.ContentLength(); copyErr == nil && cl >= 0 && written < int64(cl) {
+		copyErr = io.ErrUnexpectedEOF // The streamed body ends in a plain EOF when the client goes away
+	}
+	if written > remaining {
+		part.Truncate(offset)
+		return c.Status(fiber.StatusRequestEntityTooLarge).SendString("Chunk exceeds Upload-Length")
+	}
+	if hasher != nil && (copyErr != nil || !bytes.Equal(hasher.Sum(nil), expected)) {
+		// Discard the whole chunk; the client retries from the old offset
+		part.Truncate(offset)
+		if copyErr != nil {
+			return c.SendStatus(fiber.StatusBadRequest)
+		}
+		return c.Status(tusStatusChecksumFail).SendString("Checksum Mismatch")
+	}
+	// Without a checksum, keep whatever arrived before a disconnect so the client can resume
+	if err := part.Sync(); err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
+	}
+
+	upload.Offset = offset + written
+	upload.ExpiresAt = time.Now().Add(tusExpiry())
+	DB.Model(upload).Updates(map[string]interface{}{"offset": upload.Offset, "expires_at": upload.ExpiresAt})
+
+	c.Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	if copyErr != nil && !errors.Is(copyErr, io.EOF) {
+		// The body broke off: the bytes that arrived are kept, but this is no success
+		return c.Status(fiber.StatusBadRequest).SendString("Upload interrupted: " + copyErr.Error())
+	}
+
+	if upload.Offset == upload.Length {
+		part.Close()
+		if err := finishTusUpload(upload); err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString("Failed to place upload: " + err.Error())
+		}
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func TusDelete(c *fiber.Ctx) error {
+	upload, mu, ok := lockTusUpload(c)
+	if !ok {
+		return nil
+	}
+	defer mu.Unlock()
+	os.Remove(upload.PartPath)
+	DB.Delete(upload)
+	tusLocks.Delete(upload.ID)
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// finishTusUpload moves the completed staging file into place and logs it
+func finishTusUpload(upload *FileUpload) error {
+	previous := snapshotFileBeforeChange(upload.Path)
+	if err := placeFile(upload.PartPath, upload.Path); err != nil {
+		auditFile(upload.UserID, "FILE_UPLOAD", upload.Path, "", upload.Length, "Resumable upload", err)
+		return err
+	}
+	DB.Delete(upload)
+	tusLocks.Delete(upload.ID)
+	recordUpload(upload.UserID, upload.Path, upload.Length, previous)
+	return nil
+}
+
+// tusJanitor removes uploads that were abandoned past their expiry
+func tusJanitor() {
+	ticker := time.NewTicker(10 * time.Minute)
+	defer ticker.Stop()
+	for {
+		var expired []FileUpload
+		DB.Where("expires_at < ?", time.Now()).Find(&expired)
+		for _, u := range expired {
+			// A PATCH in progress may finish or extend the upload first
+			mu := tusLock(u.ID)
+			mu.Lock()
+			if DB.First(&u, "id = ? AND expires_at < ?", u.ID, time.Now()).Error == nil {
+				os.Remove(u.PartPath)
+				DB.Delete(&u)
+				tusLocks.Delete(u.ID)
+				log.Printf("Expired abandoned upload %s for %s (%d/%d bytes)", u.ID, u.Path, u.Offset, u.Length)
+			}
+			mu.Unlock()
+		}
+		<-ticker.C
+	}
+}
+
+// parseTusMetadata decodes "key base64value,key2 base64value2"
+func parseTusMetadata(header string) map[string]string {
+	meta := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			continue
+		}
+		meta[key] = string(decoded)
+	}
+	return meta
+}
+
+func newChecksumHash(algo string) hash.Hash {
+	switch algo {
+	case "md5":
+		return md5.New()
+	case "sha1":
+		return sha1.New()
+	case "sha256":
+		return sha256.New()
+	case "sha512":
+		return sha512.New()
+	}
+	return nil
+}
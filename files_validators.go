@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// ==================== WRITE VALIDATORS ====================
+// Admins register validators per path glob. write runs every matching
+// validator against the candidate content before it replaces the file, so a
+// broken nginx, sshd or sudoers config never lands on disk.
+
+// FileValidatorRule maps a glob to a built-in validator or a shell command
+type FileValidatorRule struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	Pattern   string    `json:"pattern"`           // Glob on the absolute path, "**" crosses directories
+	Builtin   string    `json:"builtin,omitempty"` // nginx, sshd, visudo, json, yaml, systemd
+	Command   string    `json:"command,omitempty"` // Used when Builtin is empty, see commandValidator
+	Enabled   bool      `json:"enabled"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+const validatorsSeededSetting = "FILE_VALIDATORS_SEEDED"
+
+// Registered on first start; admins can disable or delete them. Only system
+// configs a service would choke on are covered: strict json would also
+// reject JSONC, tsconfig.json comments or an empty new file, so the json and
+// yaml builtins are opt-in for the patterns an admin picks.
+var defaultValidatorRules = []FileValidatorRule{
+	{Pattern: "/etc/nginx/**", Builtin: "nginx"},
+	{Pattern: "/etc/ssh/sshd_config", Builtin: "sshd"},
+	{Pattern: "/etc/ssh/sshd_config.d/*.conf", Builtin: "sshd"},
+	{Pattern: "/etc/sudoers", Builtin: "visudo"},
+	{Pattern: "/etc/sudoers.d/*", Builtin: "visudo"},
+	{Pattern: "/etc/systemd/system/**", Builtin: "systemd"},
+	{Pattern: "/lib/systemd/system/**", Builtin: "systemd"},
+}
+
+var builtinValidators = map[string]func(ctx context.Context, candidate, target string) (string, error){
+	"nginx":   validateNginx,
+	"sshd":    validateSshd,
+	"visudo":  validateCommandOn("visudo", "-c", "-f"),
+	"json":    validateJSON,
+	"yaml":    validateYAML,
+	"systemd": validateSystemdUnit,
+}
+
+// seedValidatorRules registers the defaults once; the flag keeps rules an
+// admin deleted from coming back on the next start
+func seedValidatorRules() {
+	if getSetting(validatorsSeededSetting, "") != "" {
+		return
+	}
+	var count int64
+	DB.Model(&FileValidatorRule{}).Count(&count)
+	if count == 0 { // Installs from before the flag already have their rules
+		for _, rule := range defaultValidatorRules {
+			rule.Enabled = true
+			rule.CreatedAt = time.Now()
+			DB.Create(&rule)
+		}
+	}
+	DB.Save(&SystemSetting{Key: validatorsSeededSetting, Value: "true"})
+}
+
+// validatorsFor returns the enabled validators whose glob matches path
+func validatorsFor(path string) []fileValidator {
+	var rules []FileValidatorRule
+	DB.Where("enabled = ?", true).Order("id asc").Find(&rules)
+
+	var validators []fileValidator
+	for _, rule := range rules {
+		re, err := regexp.Compile("^" + globToRegexp(rule.Pattern) + "$")
+		if err != nil || !re.MatchString(path) {
+			continue
+		}
+		if rule.Builtin != "" {
+			if run, ok := builtinValidators[rule.Builtin]; ok {
+				validators = append(validators, fileValidator{Name: rule.Builtin, Run: run})
+			}
+		} else if rule.Command != "" {
+			validators = append(validators, commandValidator(rule.Pattern, rule.Command))
+		}
+	}
+	return validators
+}
+
+// validateCommandOn runs "<bin> <args...> <candidate>". A missing binary
+// skips validation: the service can't be running the file anyway.
+func validateCommandOn(bin string, args ...string) func(ctx context.Context, candidate, target string) (string, error) {
+	return func(ctx context.Context, candidate, target string) (string, error) {
+		path, err := exec.LookPath(bin)
+		if err != nil {
+			log.Printf("files: %s not installed, skipping validation of %s", bin, target)
+			return "", nil
+		}
+		return runValidatorCommand(ctx, path, append(args, candidate)...)
+	}
+}
+
+func runValidatorCommand(ctx context.Context, name string, args ...string) (string, error) {
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		err = fmt.Errorf("timed out after %s", validateTimeout)
+	}
+	return strings.TrimSpace(out.String()), err
+}
+
+// validateNginx tests the whole configuration with the candidate in place.
+// /etc/nginx is copied to a temp dir (with absolute references to it
+// rewritten) so the live config is never touched.
+func validateNginx(ctx context.Context, candidate, target string) (string, error) {
+	bin, err := exec.LookPath("nginx")
+	if err != nil {
+		log.Printf("files: nginx not installed, skipping validation of %s", target)
+		return "", nil
+	}
+	const root = "/etc/nginx"
+	rel, err := filepath.Rel(root, target)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return runValidatorCommand(ctx, bin, "-t", "-q")
+	}
+
+	tmpRoot, err := os.MkdirTemp("", "nginx-validate-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmpRoot)
+
+	err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		r, _ := filepath.Rel(root, p)
+		dst := filepath.Join(tmpRoot, r)
+		if d.IsDir() {
+			return os.MkdirAll(dst, 0700)
+		}
+		src := p
+		if d.Type()&fs.ModeSymlink != 0 {
+			// sites-enabled style links: point at the copy of whatever they resolve to
+			real, err := filepath.EvalSymlinks(p)
+			if err != nil {
+				return nil
+			}
+			if info, err := os.Stat(real); err == nil && info.IsDir() {
+				if r, err := filepath.Rel(root, real); err == nil && !strings.HasPrefix(r, "..") {
+					real = filepath.Join(tmpRoot, r)
+				}
+				return os.Symlink(real, dst)
+			}
+			src = real
+		}
+		if src == target {
+			src = candidate
+		}
+		data, err := os.ReadFile(src)
+		if err != nil {
+			return err
+		}
+		data = bytes.ReplaceAll(data, []byte(root+"/"), []byte(tmpRoot+"/"))
+		return os.WriteFile(dst, data, 0600)
+	})
+	if err != nil {
+		return "", err
+	}
+	// A new file isn't in the tree yet
+	if _, err := os.Stat(filepath.Join(tmpRoot, rel)); os.IsNotExist(err) {
+		data, err := os.ReadFile(candidate)
+		if err != nil {
+			return "", err
+		}
+		os.MkdirAll(filepath.Dir(filepath.Join(tmpRoot, rel)), 0700)
+		if err := os.WriteFile(filepath.Join(tmpRoot, rel), bytes.ReplaceAll(data, []byte(root+"/"), []byte(tmpRoot+"/")), 0600); err != nil {
+			return "", err
+		}
+	}
+
+	out, err := runValidatorCommand(ctx, bin, "-t", "-q", "-c", filepath.Join(tmpRoot, "nginx.conf"))
+	return strings.ReplaceAll(out, tmpRoot, root), err
+}
+
+// validateSshd tests sshd_config itself directly. A drop-in isn't a full
+// config on its own, so the main config is tested against a copy of
+// sshd_config.d with the candidate in place; its Include must use the
+// absolute /etc/ssh/sshd_config.d path, as distributions ship it.
+func validateSshd(ctx context.Context, candidate, target string) (string, error) {
+	bin, err := exec.LookPath("sshd")
+	if err != nil {
+		log.Printf("files: sshd not installed, skipping validation of %s", target)
+		return "", nil
+	}
+	const mainConfig, dropins = "/etc/ssh/sshd_config", "/etc/ssh/sshd_config.d"
+	if filepath.Dir(target) != dropins {
+		return runValidatorCommand(ctx, bin, "-t", "-f", candidate)
+	}
+
+	tmpRoot, err := os.MkdirTemp("", "sshd-validate-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmpRoot)
+	tmpDropins := filepath.Join(tmpRoot, "sshd_config.d")
+	if err := os.Mkdir(tmpDropins, 0700); err != nil {
+		return "", err
+	}
+
+	entries, _ := os.ReadDir(dropins)
+	for _, e := range entries {
+		if e.IsDir() || filepath.Join(dropins, e.Name()) == target {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dropins, e.Name()))
+		if err != nil {
+			return "", err
+		}
+		if err := os.WriteFile(filepath.Join(tmpDropins, e.Name()), data, 0600); err != nil {
+			return "", err
+		}
+	}
+	data, err := os.ReadFile(candidate)
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(tmpDropins, filepath.Base(target)), data, 0600); err != nil {
+		return "", err
+	}
+
+	config, err := os.ReadFile(mainConfig)
+	if err != nil {
+		return "", err
+	}
+	config = bytes.ReplaceAll(config, []byte(dropins+"/"), []byte(tmpDropins+"/"))
+	tmpConfig := filepath.Join(tmpRoot, "sshd_config")
+	if err := os.WriteFile(tmpConfig, config, 0600); err != nil {
+		return "", err
+	}
+
+	out, err := runValidatorCommand(ctx, bin, "-t", "-f", tmpConfig)
+	out = strings.ReplaceAll(out, tmpDropins, dropins)
+	return strings.ReplaceAll(out, tmpConfig, mainConfig), err
+}
+
+// validateSystemdUnit runs systemd-analyze verify on a copy named like the
+// target, since the unit type comes from the file extension
+func validateSystemdUnit(ctx context.Context, candidate, target string) (string, error) {
+	bin, err := exec.LookPath("systemd-analyze")
+	if err != nil {
+		log.Printf("files: systemd-analyze not installed, skipping validation of %s", target)
+		return "", nil
+	}
+	switch filepath.Ext(target) {
+	case ".service", ".socket", ".timer", ".mount", ".automount", ".path", ".target", ".slice", ".swap", ".device", ".scope":
+	default:
+		return "", nil // Drop-ins and other files aren't units on their own
+	}
+	dir, err := os.MkdirTemp("", "unit-validate-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+	data, err := os.ReadFile(candidate)
+	if err != nil {
+		return "", err
+	}
+	unit := filepath.Join(dir, filepath.Base(target))
+	if err := os.WriteFile(unit, data, 0644); err != nil {
+		return "", err
+	}
+	out, err := runValidatorCommand(ctx, bin, "verify", unit)
+	return strings.ReplaceAll(out, unit, target), err
+}
+
+func validateJSON(ctx context.Context, candidate, target string) (string, error) {
+	data, err := os.ReadFile(candidate)
+	if err != nil {
+		return "", err
+	}
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		var syntax *json.SyntaxError
+		if errors.As(err, &syntax) {
+			line := bytes.Count(data[:syntax.Offset], []byte("\n")) + 1
+			return fmt.Sprintf("line %d: %s", line, syntax.Error()), errors.New("invalid JSON")
+		}
+		return err.Error(), errors.New("invalid JSON")
+	}
+	return "", nil
+}
+
+func validateYAML(ctx context.Context, candidate, target string) (string, error) {
+	data, err := os.ReadFile(candidate)
+	if err != nil {
+		return "", err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		var v interface{}
+		err := dec.Decode(&v)
+		if err == nil {
+			continue
+		}
+		if errors.Is(err, io.EOF) {
+			return "", nil
+		}
+		return err.Error(), errors.New("invalid YAML")
+	}
+}
+
+// ==================== VALIDATOR ADMIN API ====================
+
+func GetValidatorRules(c *fiber.Ctx) error {
+	var rules []FileValidatorRule
+	DB.Order("id asc").Find(&rules)
+	builtins := make([]string, 0, len(builtinValidators))
+	for name := range builtinValidators {
+		builtins = append(builtins, name)
+	}
+	sort.Strings(builtins)
+	return c.JSON(fiber.Map{"rules": rules, "builtins": builtins})
+}
+
+func checkValidatorRule(rule *FileValidatorRule) error {
+	if rule.Pattern == "" {
+		return errors.New("pattern required")
+	}
+	if _, err := regexp.Compile("^" + globToRegexp(rule.Pattern) + "$"); err != nil {
+		return fmt.Errorf("invalid pattern: %v", err)
+	}
+	if rule.Builtin == "" && rule.Command == "" {
+		return errors.New("builtin or command required")
+	}
+	if rule.Builtin != "" {
+		if _, ok := builtinValidators[rule.Builtin]; !ok {
+			return fmt.Errorf("unknown builtin validator %q", rule.Builtin)
+		}
+	}
+	return nil
+}
+
+func CreateValidatorRule(c *fiber.Ctx) error {
+	rule := FileValidatorRule{Enabled: true}
+	if err := c.BodyParser(&rule); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Invalid input"})
+	}
+	rule.ID = 0
+	rule.CreatedAt = time.Now()
+	if err := checkValidatorRule(&rule); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": err.Error()})
+	}
+	DB.Create(&rule)
+	return c.JSON(rule)
+}
+
+func UpdateValidatorRule(c *fiber.Ctx) error {
+	var rule FileValidatorRule
+	if err := DB.First(&rule, c.Params("id")).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": "Validator not found"})
+	}
+	id, created := rule.ID, rule.CreatedAt
+	if err := c.BodyParser(&rule); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Invalid input"})
+	}
+	rule.ID, rule.CreatedAt = id, created
+	if err := checkValidatorRule(&rule); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": err.Error()})
+	}
+	DB.Save(&rule)
+	return c.JSON(rule)
+}
+
+func DeleteValidatorRule(c *fiber.Ctx) error {
+	if err := DB.Delete(&FileValidatorRule{}, c.Params("id")).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "Failed to delete validator"})
+	}
+	return c.JSON(fiber.Map{"message": "Validator deleted"})
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ==================== FILE VERSION DIFF / RESTORE / BLAME ====================
+// Server-side views over FileVersion snapshots: unified diffs between two
+// versions (or a version and the file on disk), restoring a version, and a
+// per-line blame showing whose write introduced each line.
+
+const (
+	defaultDiffContext = 3
+	diffMaxLines       = 200000 // Combined lines on both sides before a diff is refused
+	// Edit distance (lines added plus removed, after trimming the common
+	// start and end) before a diff is given up. The trace costs about
+	// diffMaxEdits^2 ints, so this caps its memory near 32MB.
+	diffMaxEdits = 2000
+)
+
+var errTooDifferent = errors.New("files are too different to diff")
+
+type diffOp struct {
+	Kind byte // ' ' equal, '-' removed from a, '+' added from b
+	A, B int  // Line indexes into a and b (only the relevant one is set for -/+)
+}
+
+// splitLines splits content into lines without their trailing newline. A
+// final newline does not produce an extra empty line.
+func splitLines(content string) []string {
+	if content == "" {
+		return nil
+	}
+	lines := strings.Split(content, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines computes a shortest edit script between a and b (Myers, O(ND)).
+// The common start and end are matched up front; each round of the search
+// only stores the band of diagonals it touched, so memory is O(D^2) and
+// errTooDifferent is returned past diffMaxEdits.
+func diffLines(a, b []string) ([]diffOp, error) {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	ops := make([]diffOp, 0, len(a)+len(b)-prefix-suffix)
+	for i := 0; i < prefix; i++ {
+		ops = append(ops, diffOp{Kind: ' ', A: i, B: i})
+	}
+	middle, err := diffMiddle(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range middle {
+		op.A += prefix
+		op.B += prefix
+		ops = append(ops, op)
+	}
+	for i := 0; i < suffix; i++ {
+		ops = append(ops, diffOp{Kind: ' ', A: len(a) - suffix + i, B: len(b) - suffix + i})
+	}
+	return ops, nil
+}
+
+// diffMiddle is the Myers search proper, for slices that differ at both ends
+func diffMiddle(a, b []string) ([]diffOp, error) {
+	n, m := len(a), len(b)
+	if n == 0 || m == 0 {
+		// Pure insertion or removal needs no search
+		ops := make([]diffOp, 0, n+m)
+		for i := 0; i < n; i++ {
+			ops = append(ops, diffOp{Kind: '-', A: i})
+		}
+		for j := 0; j < m; j++ {
+			ops = append(ops, diffOp{Kind: '+', B: j})
+		}
+		return ops, nil
+	}
+	max := n + m
+	off := max + 1
+	v := make([]int, 2*max+3)
+	var trace [][]int
+
+	found := false
+	for d := 0; d <= max && !found; d++ {
+		if d > diffMaxEdits {
+			return nil, errTooDifferent
+		}
+		band := make([]int, 2*d+3)
+		copy(band, v[off-d-1:off+d+2])
+		trace = append(trace, band)
+
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+				x = v[off+k+1]
+			} else {
+				x = v[off+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[off+k] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+	}
+
+	// Walk the trace backwards to recover the edit script
+	var ops []diffOp
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		band := trace[d]
+		at := func(k int) int { return band[k+d+1] }
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := at(prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			ops = append(ops, diffOp{Kind: ' ', A: x - 1, B: y - 1})
+			x--
+			y--
+		}
+		if d > 0 {
+			if x == prevX {
+				ops = append(ops, diffOp{Kind: '+', A: x, B: y - 1})
+			} else {
+				ops = append(ops, diffOp{Kind: '-', A: x - 1, B: y})
+			}
+		}
+		x, y = prevX, prevY
+	}
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops, nil
+}
+
+// unifiedDiff renders ops as a unified diff with the given context lines.
+// It returns the text plus counts of added and removed lines.
+func unifiedDiff(fromName, toName string, a, b []string, ops []diffOp, context int) (string, int, int) {
+	added, removed := 0, 0
+	var changes []int
+	for i, op := range ops {
+		switch op.Kind {
+		case '+':
+			added++
+			changes = append(changes, i)
+		case '-':
+			removed++
+			changes = append(changes, i)
+		}
+	}
+	if len(changes) == 0 {
+		return "", 0, 0
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", fromName, toName)
+
+	for c := 0; c < len(changes); {
+		// Extend the hunk while the next change is within 2*context lines
+		start := changes[c] - context
+		if start < 0 {
+			start = 0
+		}
+		end := changes[c]
+		for c < len(changes) && changes[c]-end <= 2*context {
+			end = changes[c]
+			c++
+		}
+		end += context
+		if end >= len(ops) {
+			end = len(ops) - 1
+		}
+
+		// Hunk header positions are 1-based; an empty side points at the line before
+		aStart, bStart := ops[start].A, ops[start].B
+		aLen, bLen := 0, 0
+		for _, op := range ops[start : end+1] {
+			if op.Kind != '+' {
+				aLen++
+			}
+			if op.Kind != '-' {
+				bLen++
+			}
+		}
+		if aLen > 0 {
+			aStart++
+		}
+		if bLen > 0 {
+			bStart++
+		}
+		fmt.Fprintf(&sb, "@@ -%d,%d +%d,%d @@\n", aStart, aLen, bStart, bLen)
+		for _, op := range ops[start : end+1] {
+			switch op.Kind {
+			case ' ':
+				sb.WriteString(" " + a[op.A] + "\n")
+			case '-':
+				sb.WriteString("-" + a[op.A] + "\n")
+			case '+':
+				sb.WriteString("+" + b[op.B] + "\n")
+			}
+		}
+	}
+	return sb.String(), added, removed
+}
+
+// diffSide resolves a diff endpoint: a version id or "current" for the file on disk
+func diffSide(ref, path string) (content, name, resolvedPath string, err error) {
+	if ref == "current" {
+		if path == "" {
+			return "", "", "", fmt.Errorf("path required to diff against the current file")
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", "", "", err
+		}
+		return string(data), path + " (current)", path, nil
+	}
+	var version FileVersion
+	if err := DB.First(&version, ref).Error; err != nil {
+		return "", "", "", fmt.Errorf("version %s not found", ref)
+	}
+	data, err := versionData(&version)
+	if err != nil {
+		return "", "", "", err
+	}
+	return string(data), fmt.Sprintf("%s (version %d, %s)", version.Path, version.ID, version.CreatedAt.Format(time.RFC3339)), version.Path, nil
+}
+
+// DiffFileVersions returns a unified diff between two snapshots.
+// Query: from (version id), to (version id or "current", default "current"),
+// path (only needed when from is "current"), context (lines, default 3).
+func DiffFileVersions(c *fiber.Ctx) error {
+	from := c.Query("from")
+	to := c.Query("to", "current")
+	if from == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "from required"})
+	}
+	context := c.QueryInt("context", defaultDiffContext)
+	if context < 0 {
+		context = 0
+	}
+
+	fromContent, fromName, fromPath, err := diffSide(from, c.Query("path"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": err.Error()})
+	}
+	path := c.Query("path", fromPath)
+	toContent, toName, _, err := diffSide(to, path)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": err.Error()})
+	}
+
+	result := fiber.Map{"from": from, "to": to, "path": path}
+
+	if isBinaryContent([]byte(fromContent)) || isBinaryContent([]byte(toContent)) {
+		result["binary"] = true
+		result["identical"] = fromContent == toContent
+		result["diff"] = ""
+		if fromContent != toContent {
+			result["diff"] = fmt.Sprintf("Binary files %s and %s differ\n", fromName, toName)
+		}
+		return c.JSON(result)
+	}
+
+	a, b := splitLines(fromContent), splitLines(toContent)
+	if len(a)+len(b) > diffMaxLines {
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{"message": "Files too large to diff"})
+	}
+	ops, err := diffLines(a, b)
+	if err != nil {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{"message": "Files are too different to diff"})
+	}
+	text, added, removed := unifiedDiff(fromName, toName, a, b, ops, context)
+	result["binary"] = false
+	result["identical"] = fromContent == toContent
+	result["diff"] = text
+	result["added"] = added
+	result["removed"] = removed
+	return c.JSON(result)
+}
+
+// RestoreFileVersion writes a snapshot back to its path. The restore is
+// validated, logged and snapshotted like any other write so a stale config
+// can't bypass the validators and the restore can itself be undone.
+// Query: skipValidation=true (admins only).
+func RestoreFileVersion(c *fiber.Ctx) error {
+	claims := c.Locals("user").(jwt.MapClaims)
+	userIdFloat, _ := claims["iss"].(float64)
+	userID := uint(userIdFloat)
+	role, _ := claims["role"].(string)
+	skip := c.Query("skipValidation") == "true"
+	if skip && role != "admin" {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": "Admin access required for skipValidation", "code": "EPERM"})
+	}
+
+	var version FileVersion
+	if err := DB.First(&version, c.Params("id")).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": "Version not found"})
+	}
+
+	data, err := versionData(&version)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": err.Error()})
+	}
+	var validators []fileValidator
+	if !skip {
+		validators = validatorsFor(resolveTarget(version.Path))
+	}
+
+	unlockPath := lockEditPath(version.Path)
+	previous := snapshotFileBeforeChange(version.Path)
+	err = atomicWriteFile(version.Path, data, validators...)
+	unlockPath()
+	logEntry := auditFile(userID, "FILE_RESTORE_VERSION", version.Path, "", int64(len(data)),
+		fmt.Sprintf("Restore version %d", version.ID), err)
+	var invalid *validationError
+	if errors.As(err, &invalid) {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"message":    err.Error(),
+			"code":       errorCode(err),
+			"validation": fiber.Map{"validator": invalid.Validator, "output": invalid.Output},
+		})
+	} else if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": err.Error(), "code": errorCode(err)})
+	}
+
+	saveSnapshots(logEntry.ID, "pre_write", previous)
+
+	resp := fiber.Map{"message": "Version restored", "restoredFrom": version.ID}
+	// No new version when the file already matched the latest snapshot
+	if restored, err := saveFileVersion(logEntry.ID, version.Path, "restore", data); err == nil && restored != nil {
+		resp["version"] = restored.ID
+	}
+	return c.JSON(resp)
+}
+
+type blameLine struct {
+	Line      int       `json:"line"`
+	Text      string    `json:"text"`
+	VersionID uint      `json:"version_id"`
+	UserID    uint      `json:"user_id"`
+	Username  string    `json:"username"`
+	External  bool      `json:"external,omitempty"` // Changed outside the file manager, author unknown
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// BlameFile attributes each line of a file to the version (and user) that
+// introduced it by replaying the diffs between consecutive snapshots.
+// Query: path, version (blame as of that version, default the latest).
+// Lines that first appear in a pre_* snapshot were changed outside the file
+// manager, so they are marked external instead of credited to a user.
+func BlameFile(c *fiber.Ctx) error {
+	path := c.Query("path")
+	if path == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "path required"})
+	}
+
+	query := DB.Where("path = ?", path)
+	if at := c.Query("version"); at != "" {
+		id, err := strconv.Atoi(at)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "invalid version"})
+		}
+		query = query.Where("id <= ?", id)
+	}
+	var versions []FileVersion
+	query.Order("created_at asc, id asc").Find(&versions)
+	if len(versions) == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"message": "No versions for this path"})
+	}
+
+	// Resolve who made each version through its activity log entry
+	logIDs := make([]uint, 0, len(versions))
+	for _, v := range versions {
+		logIDs = append(logIDs, v.LogID)
+	}
+	var authors []struct {
+		ID       uint
+		UserID   uint
+		Username string
+	}
+	DB.Table("activity_logs").
+		Select("activity_logs.id, activity_logs.user_id, users.username").
+		Joins("LEFT JOIN users ON users.id = activity_logs.user_id").
+		Where("activity_logs.id IN ?", logIDs).
+		Scan(&authors)
+	authorByLog := map[uint]int{}
+	for i, a := range authors {
+		authorByLog[a.ID] = i
+	}
+
+	// origin[i] is the index into versions that introduced line i
+	var lines []string
+	var origin []int
+	var latestData []byte
+	for vi := range versions {
+		if versions[vi].Binary {
+			return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{"message": "Blame is not available for binary files"})
+		}
+		data, err := versionData(&versions[vi])
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": err.Error()})
+		}
+		latestData = data
+		next := splitLines(string(data))
+		if len(lines)+len(next) > diffMaxLines {
+			return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{"message": "File too large to blame"})
+		}
+		ops, err := diffLines(lines, next)
+		if err != nil {
+			// Too different to line up: treat the version as a rewrite
+			ops, _ = diffMiddle(nil, next)
+		}
+		nextOrigin := make([]int, 0, len(next))
+		for _, op := range ops {
+			switch op.Kind {
+			case ' ':
+				nextOrigin = append(nextOrigin, origin[op.A])
+			case '+':
+				nextOrigin = append(nextOrigin, vi)
+			}
+		}
+		lines, origin = next, nextOrigin
+	}
+
+	result := make([]blameLine, len(lines))
+	for i, text := range lines {
+		v := versions[origin[i]]
+		line := blameLine{Line: i + 1, Text: text, VersionID: v.ID, CreatedAt: v.CreatedAt}
+		if strings.HasPrefix(v.Reason, "pre_") {
+			// A pre_* snapshot holds what was on disk before someone's change;
+			// its log entry is that change, not whoever produced this content
+			line.External = true
+		} else if ai, ok := authorByLog[v.LogID]; ok {
+			line.UserID = authors[ai].UserID
+			line.Username = authors[ai].Username
+		}
+		result[i] = line
+	}
+
+	latest := versions[len(versions)-1]
+	resp := fiber.Map{"path": path, "version": latest.ID, "lines": result}
+	// Flag when the file on disk has moved on from the newest snapshot
+	if data, err := os.ReadFile(path); err == nil {
+		resp["modifiedSinceVersion"] = !bytes.Equal(data, latestData)
+	}
+	return c.JSON(resp)
+}
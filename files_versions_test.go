@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// applyOps rebuilds both sides from an edit script
+func applyOps(a, b []string, ops []diffOp) ([]string, []string) {
+	var gotA, gotB []string
+	for _, op := range ops {
+		switch op.Kind {
+		case ' ':
+			gotA = append(gotA, a[op.A])
+			gotB = append(gotB, b[op.B])
+		case '-':
+			gotA = append(gotA, a[op.A])
+		case '+':
+			gotB = append(gotB, b[op.B])
+		}
+	}
+	return gotA, gotB
+}
+
+func TestDiffLines(t *testing.T) {
+	a := splitLines("head\none\ntwo\nthree\nfour\ntail\n")
+	b := splitLines("head\none\n2\nthree\nfive\nsix\ntail\n")
+	ops, err := diffLines(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotA, gotB := applyOps(a, b, ops)
+	if fmt.Sprint(gotA) != fmt.Sprint(a) || fmt.Sprint(gotB) != fmt.Sprint(b) {
+		t.Fatalf("edit script does not rebuild the inputs: %v / %v", gotA, gotB)
+	}
+	changed := 0
+	for _, op := range ops {
+		if op.Kind != ' ' {
+			changed++
+		}
+	}
+	if changed != 5 {
+		t.Errorf("got %d changed lines, want 5", changed)
+	}
+}
+
+// Unrelated files must be refused rather than growing the trace without bound,
+// while a whole file added or removed needs no search at all
+func TestDiffLinesTooDifferent(t *testing.T) {
+	var a, b []string
+	for i := 0; i < 4000; i++ {
+		a = append(a, fmt.Sprintf("a%d", i))
+		b = append(b, fmt.Sprintf("b%d", i))
+	}
+	if _, err := diffLines(a, b); err != errTooDifferent {
+		t.Fatalf("got %v, want errTooDifferent", err)
+	}
+	ops, err := diffLines(nil, b)
+	if err != nil || len(ops) != len(b) {
+		t.Fatalf("adding a file: %d ops, %v", len(ops), err)
+	}
+}
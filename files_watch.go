@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// ==================== DIRECTORY WATCHING ====================
+// watch/unwatch actions subscribe a files connection to inotify events for
+// directories; changes are pushed as batched watch_events messages.
+
+const (
+	defaultWatchLimit  = 16 // Directories per connection, override with FILES_WATCH_LIMIT
+	watchFlushInterval = 250 * time.Millisecond
+)
+
+type watchEvent struct {
+	Dir  string `json:"dir"`  // Watched directory
+	Path string `json:"path"` // Entry that changed
+	Name string `json:"name"`
+	Op   string `json:"op"` // create, modify, delete, rename, chmod
+}
+
+type dirWatcher struct {
+	mu      sync.Mutex
+	w       *fsnotify.Watcher
+	dirs    map[string]bool
+	pending []watchEvent
+	conn    *filesConn
+}
+
+func (c *filesConn) watchDir(dir string) error {
+	c.watchMu.Lock()
+	if c.watcher == nil {
+		w, err := fsnotify.NewWatcher()
+		if err != nil {
+			c.watchMu.Unlock()
+			return err
+		}
+		c.watcher = &dirWatcher{w: w, dirs: make(map[string]bool), conn: c}
+		go c.watcher.run()
+	}
+	dw := c.watcher
+	c.watchMu.Unlock()
+
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+	if dw.dirs[dir] {
+		return nil
+	}
+	if limit := getSettingInt("FILES_WATCH_LIMIT", defaultWatchLimit); int64(len(dw.dirs)) >= limit {
+		return fmt.Errorf("watch limit reached (%d directories)", limit)
+	}
+	if err := dw.w.Add(dir); err != nil {
+		return err
+	}
+	dw.dirs[dir] = true
+	return nil
+}
+
+func (c *filesConn) unwatchDir(dir string) error {
+	c.watchMu.Lock()
+	dw := c.watcher
+	c.watchMu.Unlock()
+	if dw == nil {
+		return errors.New("not watching " + dir)
+	}
+
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+	if !dw.dirs[dir] {
+		return errors.New("not watching " + dir)
+	}
+	delete(dw.dirs, dir)
+	return dw.w.Remove(dir)
+}
+
+// moveWatches re-keys watches on from and the directories below it to to
+// after a rename or move, or drops them when to is empty (rm, trash)
+func (c *filesConn) moveWatches(from, to string) {
+	c.watchMu.Lock()
+	dw := c.watcher
+	c.watchMu.Unlock()
+	if dw == nil {
+		return
+	}
+
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+	for dir := range dw.dirs {
+		if !pathWithin(dir, from) {
+			continue
+		}
+		if _, err := os.Stat(dir); err == nil {
+			continue // Left behind, e.g. a move that skipped conflicts
+		}
+		dw.w.Remove(dir) // Already gone when the kernel dropped the watch itself
+		delete(dw.dirs, dir)
+		if to == "" {
+			continue
+		}
+		moved := filepath.Join(to, dir[len(from):])
+		if dw.w.Add(moved) == nil {
+			dw.dirs[moved] = true
+		}
+	}
+}
+
+// closeWatcher releases inotify watches when the connection ends
+func (c *filesConn) closeWatcher() {
+	c.watchMu.Lock()
+	defer c.watchMu.Unlock()
+	if c.watcher != nil {
+		c.watcher.w.Close()
+		c.watcher = nil
+	}
+}
+
+func (dw *dirWatcher) run() {
+	ticker := time.NewTicker(watchFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case ev, ok := <-dw.w.Events:
+			if !ok {
+				return
+			}
+			dw.mu.Lock()
+			dw.pending = append(dw.pending, watchEvent{
+				Dir:  filepath.Dir(ev.Name),
+				Path: ev.Name,
+				Name: filepath.Base(ev.Name),
+				Op:   watchOp(ev.Op),
+			})
+			// A watched directory that is deleted or moved away stops producing events
+			if dw.dirs[ev.Name] && ev.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+				dw.w.Remove(ev.Name)
+				delete(dw.dirs, ev.Name)
+			}
+			dw.mu.Unlock()
+
+		case err, ok := <-dw.w.Errors:
+			if !ok {
+				return
+			}
+			dw.conn.WriteJSON(map[string]interface{}{"action": "watch_events", "error": err.Error()})
+
+		case <-ticker.C:
+			dw.mu.Lock()
+			batch := dw.pending
+			dw.pending = nil
+			dw.mu.Unlock()
+			if len(batch) > 0 {
+				dw.conn.WriteJSON(map[string]interface{}{"action": "watch_events", "data": batch})
+			}
+		}
+	}
+}
+
+func watchOp(op fsnotify.Op) string {
+	switch {
+	case op.Has(fsnotify.Create):
+		return "create"
+	case op.Has(fsnotify.Remove):
+		return "delete"
+	case op.Has(fsnotify.Rename):
+		return "rename"
+	case op.Has(fsnotify.Write):
+		return "modify"
+	default:
+		return "chmod"
+	}
+}
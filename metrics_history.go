@@ -0,0 +1,353 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/shirou/gopsutil/v3/disk"
+	"github.com/shirou/gopsutil/v3/load"
+	"github.com/shirou/gopsutil/v3/mem"
+	"github.com/shirou/gopsutil/v3/net"
+	"github.com/shirou/gopsutil/v3/process"
+	"gorm.io/gorm/clause"
+)
+
+// ==================== METRICS HISTORY ====================
+// A background collector samples the host every METRICS_INTERVAL_SECONDS
+// into metric_points_raw. Complete minutes are rolled up into
+// metric_points_1m and complete hours into metric_points_1h, each table
+// with its own retention, so last night can still be looked at next month.
+
+const (
+	defaultMetricsInterval      = 1   // Seconds, override with METRICS_INTERVAL_SECONDS (0 stops collecting)
+	defaultMetricsRawHours      = 6   // METRICS_RAW_RETENTION_HOURS
+	defaultMetricsMinuteDays    = 30  // METRICS_MINUTE_RETENTION_DAYS
+	defaultMetricsHourDays      = 365 // METRICS_HOUR_RETENTION_DAYS
+	metricsPruneInterval        = time.Hour
+	maxMetricsPointsPerSeries   = 5000 // Query responses, see pickMetricsResolution
+	metricsQueryDefaultDuration = time.Hour
+)
+
+// MetricPoint is one value of one metric. Rollup rows hold the average of
+// their bucket in Value along with its minimum and maximum.
+type MetricPoint struct {
+	Metric string  `gorm:"primaryKey" json:"-"`
+	Time   int64   `gorm:"primaryKey;autoIncrement:false" json:"t"` // Unix seconds, start of the bucket for rollups
+	Value  float64 `json:"v"`
+	Min    float64 `json:"min"`
+	Max    float64 `json:"max"`
+}
+
+// metricsResolution is one table of the store
+type metricsResolution struct {
+	Name      string
+	Table     string
+	Bucket    int64 // Seconds per point, 0 for raw samples
+	Retention func() time.Duration
+}
+
+var metricsResolutions = []metricsResolution{
+	{Name: "raw", Table: "metric_points_raw", Retention: func() time.Duration {
+		return time.Duration(getSettingInt("METRICS_RAW_RETENTION_HOURS", defaultMetricsRawHours)) * time.Hour
+	}},
+	{Name: "1m", Table: "metric_points_1m", Bucket: 60, Retention: func() time.Duration {
+		return time.Duration(getSettingInt("METRICS_MINUTE_RETENTION_DAYS", defaultMetricsMinuteDays)) * 24 * time.Hour
+	}},
+	{Name: "1h", Table: "metric_points_1h", Bucket: 3600, Retention: func() time.Duration {
+		return time.Duration(getSettingInt("METRICS_HOUR_RETENTION_DAYS", defaultMetricsHourDays)) * 24 * time.Hour
+	}},
+}
+
+func initMetricsHistory() {
+	for _, res := range metricsResolutions {
+		if err := DB.Table(res.Table).AutoMigrate(&MetricPoint{}); err != nil {
+			log.Println("metrics history disabled:", err)
+			return
+		}
+		// The primary key leads with metric; rollups, pruning and the metric
+		// list filter on time alone
+		if err := DB.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS idx_%s_time ON %s (time)", res.Table, res.Table)).Error; err != nil {
+			log.Printf("metrics: indexing %s failed: %v", res.Table, err)
+		}
+	}
+	go metricsCollector()
+}
+
+// metricsSampler turns counters into rates between two samples
+type metricsSampler struct {
+	cpu            cpuTracker
+	lastRx, lastTx uint64
+	lastTime       time.Time
+}
+
+// sample reads the current host metrics, named like the monitor payload
+func (s *metricsSampler) sample(now time.Time) map[string]float64 {
+	m := make(map[string]float64)
+
+	if cpuPerc := s.cpu.percent(false); len(cpuPerc) > 0 {
+		m["cpu.usage"] = cpuPerc[0]
+	}
+	if vMem, err := mem.VirtualMemory(); err == nil {
+		m["memory.total"] = float64(vMem.Total)
+		m["memory.used"] = float64(vMem.Used)
+		m["memory.used_percent"] = vMem.UsedPercent
+	}
+	if swap, err := mem.SwapMemory(); err == nil {
+		m["swap.used"] = float64(swap.Used)
+		m["swap.used_percent"] = swap.UsedPercent
+	}
+	if dStat, err := disk.Usage("/"); err == nil {
+		m["disk.total"] = float64(dStat.Total)
+		m["disk.used"] = float64(dStat.Used)
+		m["disk.used_percent"] = dStat.UsedPercent
+	}
+	if netStat, err := net.IOCounters(false); err == nil && len(netStat) > 0 {
+		rx, tx := netStat[0].BytesRecv, netStat[0].BytesSent
+		if !s.lastTime.IsZero() && rx >= s.lastRx && tx >= s.lastTx {
+			if duration := now.Sub(s.lastTime).Seconds(); duration > 0 {
+				m["network.rx_sec"] = float64(rx-s.lastRx) / duration
+				m["network.tx_sec"] = float64(tx-s.lastTx) / duration
+			}
+		}
+		s.lastRx, s.lastTx, s.lastTime = rx, tx, now
+	}
+	if lAvg, err := load.Avg(); err == nil {
+		m["load.1"] = lAvg.Load1
+		m["load.5"] = lAvg.Load5
+		m["load.15"] = lAvg.Load15
+	}
+	if pids, err := process.Pids(); err == nil {
+		m["processes.count"] = float64(len(pids))
+	}
+	return m
+}
+
+// metricsState is the one sampler behind both the history collector and the
+// alert evaluator, with its latest reading
+var metricsState = struct {
+	sync.Mutex
+	sampler metricsSampler
+	latest  map[string]float64
+	at      time.Time
+}{}
+
+// sampleMetrics takes a new reading and keeps it as the latest
+func sampleMetrics(now time.Time) map[string]float64 {
+	metricsState.Lock()
+	defer metricsState.Unlock()
+	metricsState.latest = metricsState.sampler.sample(now)
+	metricsState.at = now
+	return metricsState.latest
+}
+
+// currentMetrics returns the latest reading, or a new one when it is older
+// than maxAge (history collection disabled or slower than the caller)
+func currentMetrics(maxAge time.Duration) map[string]float64 {
+	metricsState.Lock()
+	if metricsState.latest != nil && time.Since(metricsState.at) <= maxAge {
+		defer metricsState.Unlock()
+		return metricsState.latest
+	}
+	metricsState.Unlock()
+	return sampleMetrics(time.Now())
+}
+
+// metricsCollector samples, rolls up and prunes until the process exits
+func metricsCollector() {
+	lastPrune := time.Time{}
+	for {
+		interval := getSettingInt("METRICS_INTERVAL_SECONDS", defaultMetricsInterval)
+		if interval <= 0 {
+			time.Sleep(time.Minute) // Disabled; check again for the setting later
+			continue
+		}
+		time.Sleep(time.Duration(interval)*time.Second - time.Duration(time.Now().UnixNano())%time.Second)
+
+		now := time.Now()
+		recordMetricSample(now.Unix(), sampleMetrics(now))
+		rollupMetrics(now.Unix())
+		if now.Sub(lastPrune) > metricsPruneInterval {
+			lastPrune = now
+			pruneMetrics(now)
+		}
+	}
+}
+
+func recordMetricSample(ts int64, sample map[string]float64) {
+	if len(sample) == 0 {
+		return
+	}
+	points := make([]MetricPoint, 0, len(sample))
+	for name, v := range sample {
+		points = append(points, MetricPoint{Metric: name, Time: ts, Value: v, Min: v, Max: v})
+	}
+	DB.Table("metric_points_raw").Clauses(clause.OnConflict{UpdateAll: true}).Create(&points)
+}
+
+// metricsRolledUp holds, per rollup table, the end of the range rolled up so
+// far. Only the collector goroutine touches it.
+var metricsRolledUp = map[string]int64{}
+
+// rollupMetrics aggregates every complete bucket not rolled up yet, each
+// level from the one below it. Between bucket boundaries it does nothing.
+func rollupMetrics(now int64) {
+	for i := 1; i < len(metricsResolutions); i++ {
+		src, dst := metricsResolutions[i-1], metricsResolutions[i]
+		end := now - now%dst.Bucket // Buckets before this one are complete
+
+		done, ok := metricsRolledUp[dst.Table]
+		if ok && done >= end {
+			continue
+		}
+		start := end - dst.Bucket
+		if ok {
+			start = done
+		} else {
+			// First pass since startup: continue after the newest stored bucket
+			var last *int64
+			DB.Table(dst.Table).Select("MAX(time)").Scan(&last)
+			if last != nil {
+				start = *last + dst.Bucket
+			} else {
+				// Empty table: roll up whatever the source table still holds
+				var first *int64
+				DB.Table(src.Table).Select("MIN(time)").Scan(&first)
+				if first != nil {
+					start = *first - *first%dst.Bucket
+				}
+			}
+		}
+		if start >= end {
+			metricsRolledUp[dst.Table] = end
+			continue
+		}
+		err := DB.Exec(fmt.Sprintf(`INSERT OR REPLACE INTO %s (metric, time, value, min, max)
+			SELECT metric, time - time %% ?, AVG(value), MIN(min), MAX(max) FROM %s
+			WHERE time >= ? AND time < ? GROUP BY metric, time - time %% ?`, dst.Table, src.Table),
+			dst.Bucket, start, end, dst.Bucket).Error
+		if err != nil {
+			log.Printf("metrics: rollup into %s failed: %v", dst.Table, err)
+			continue // Retried on the next sample
+		}
+		metricsRolledUp[dst.Table] = end
+	}
+}
+
+func pruneMetrics(now time.Time) {
+	for _, res := range metricsResolutions {
+		retention := res.Retention()
+		if retention <= 0 {
+			continue // Keep forever
+		}
+		DB.Table(res.Table).Where("time < ?", now.Add(-retention).Unix()).Delete(&MetricPoint{})
+	}
+}
+
+// parseMetricsTime accepts unix seconds, RFC 3339, "now" or a duration
+// relative to now ("-6h", "-30m", "-7d")
+func parseMetricsTime(s string, now time.Time, def time.Time) (time.Time, error) {
+	switch {
+	case s == "":
+		return def, nil
+	case s == "now":
+		return now, nil
+	case strings.HasPrefix(s, "-"):
+		if days, err := strconv.Atoi(strings.TrimSuffix(s, "d")); err == nil && strings.HasSuffix(s, "d") {
+			return now.AddDate(0, 0, days), nil
+		}
+		if d, err := time.ParseDuration(s); err == nil {
+			return now.Add(d), nil
+		}
+	}
+	if unix, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(unix, 0), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", s)
+}
+
+// pickMetricsResolution chooses the finest table that still holds from and
+// keeps series under maxMetricsPointsPerSeries points
+func pickMetricsResolution(from, to, now time.Time) metricsResolution {
+	interval := getSettingInt("METRICS_INTERVAL_SECONDS", defaultMetricsInterval)
+	if interval <= 0 {
+		interval = defaultMetricsInterval
+	}
+	span := int64(to.Sub(from).Seconds())
+	for _, res := range metricsResolutions {
+		step := res.Bucket
+		if step == 0 {
+			step = interval
+		}
+		retention := res.Retention()
+		if (retention <= 0 || from.After(now.Add(-retention))) && span/step <= maxMetricsPointsPerSeries {
+			return res
+		}
+	}
+	return metricsResolutions[len(metricsResolutions)-1]
+}
+
+// QueryMetrics returns stored series for a time range.
+// GET /api/metrics/query?metrics=cpu.usage,memory.used&from=-6h&to=now&resolution=auto|raw|1m|1h
+func QueryMetrics(c *fiber.Ctx) error {
+	now := time.Now()
+	to, err := parseMetricsTime(c.Query("to"), now, now)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": err.Error()})
+	}
+	from, err := parseMetricsTime(c.Query("from"), now, to.Add(-metricsQueryDefaultDuration))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": err.Error()})
+	}
+	if !from.Before(to) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "from must be before to"})
+	}
+
+	res := pickMetricsResolution(from, to, now)
+	if name := c.Query("resolution", "auto"); name != "auto" {
+		found := false
+		for _, r := range metricsResolutions {
+			if r.Name == name {
+				res, found = r, true
+			}
+		}
+		if !found {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "resolution must be auto, raw, 1m or 1h"})
+		}
+	}
+
+	var names []string
+	for _, name := range strings.Split(c.Query("metrics"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		DB.Table(res.Table).Distinct("metric").Where("time >= ? AND time <= ?", from.Unix(), to.Unix()).Order("metric").Pluck("metric", &names)
+	}
+
+	series := make([]fiber.Map, 0, len(names))
+	for _, name := range names {
+		var points []MetricPoint
+		DB.Table(res.Table).Where("metric = ? AND time >= ? AND time <= ?", name, from.Unix(), to.Unix()).
+			Order("time asc").Limit(maxMetricsPointsPerSeries).Find(&points)
+		if points == nil {
+			points = []MetricPoint{}
+		}
+		series = append(series, fiber.Map{"metric": name, "points": points})
+	}
+
+	return c.JSON(fiber.Map{
+		"from":       from.Unix(),
+		"to":         to.Unix(),
+		"resolution": res.Name,
+		"series":     series,
+	})
+}
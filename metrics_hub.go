@@ -0,0 +1,336 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/contrib/websocket"
+	"github.com/shirou/gopsutil/v3/cpu"
+	"github.com/shirou/gopsutil/v3/disk"
+	"github.com/shirou/gopsutil/v3/host"
+	"github.com/shirou/gopsutil/v3/load"
+	"github.com/shirou/gopsutil/v3/mem"
+	"github.com/shirou/gopsutil/v3/net"
+	"github.com/shirou/gopsutil/v3/process"
+)
+
+// ==================== MONITOR HUB ====================
+// One collector goroutine samples the host for every /ws?type=monitor
+// client. Clients subscribe to metric groups; the collector only gathers
+// groups someone wants (the process walk is by far the most expensive) and
+// stops altogether when the last client leaves.
+
+const defaultMonitorInterval = 2 // Seconds, override with MONITOR_INTERVAL_SECONDS
+
+var monitorGroups = []string{"cpu", "memory", "disk", "network", "system", "processes"}
+
+// cpuTracker computes CPU usage from the difference between two cpu.Times
+// readings, so callers sampling at different rates don't skew each other
+// the way sharing cpu.Percent(0, ...) would
+type cpuTracker struct {
+	mu   sync.Mutex
+	last []cpu.TimesStat
+}
+
+// percent returns the busy percentage since the previous call, total or per core
+func (t *cpuTracker) percent(perCPU bool) []float64 {
+	times, err := cpu.Times(perCPU)
+	if err != nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	last := t.last
+	t.last = times
+	if len(last) != len(times) {
+		return nil
+	}
+	usage := make([]float64, len(times))
+	for i := range times {
+		busy := cpuBusy(times[i]) - cpuBusy(last[i])
+		total := times[i].Total() - last[i].Total()
+		if total > 0 {
+			usage[i] = busy / total * 100
+		}
+	}
+	return usage
+}
+
+func cpuBusy(t cpu.TimesStat) float64 {
+	return t.Total() - t.Idle - t.Iowait
+}
+
+// monitorSub is one client of the hub. Updates go through a one-slot
+// channel: a slow client gets the latest snapshot, not a backlog.
+type monitorSub struct {
+	updates chan map[string]interface{}
+	mu      sync.Mutex
+	groups  map[string]bool
+}
+
+func (s *monitorSub) wants(group string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.groups[group]
+}
+
+func (s *monitorSub) setGroups(groups []string) {
+	set := make(map[string]bool)
+	for _, g := range groups {
+		set[strings.TrimSpace(g)] = true
+	}
+	if len(groups) == 0 {
+		for _, g := range monitorGroups {
+			set[g] = true
+		}
+	}
+	s.mu.Lock()
+	s.groups = set
+	s.mu.Unlock()
+}
+
+var monitorHub = struct {
+	sync.Mutex
+	subs    map[*monitorSub]bool
+	running bool
+}{subs: make(map[*monitorSub]bool)}
+
+// subscribeMonitor registers a client, starting the collector if it was idle
+func subscribeMonitor(groups []string) *monitorSub {
+	sub := &monitorSub{updates: make(chan map[string]interface{}, 1)}
+	sub.setGroups(groups)
+
+	monitorHub.Lock()
+	defer monitorHub.Unlock()
+	monitorHub.subs[sub] = true
+	if !monitorHub.running {
+		monitorHub.running = true
+		go monitorCollector()
+	}
+	return sub
+}
+
+func unsubscribeMonitor(sub *monitorSub) {
+	monitorHub.Lock()
+	defer monitorHub.Unlock()
+	delete(monitorHub.subs, sub)
+}
+
+// wantedGroups returns the union of the subscribers' groups, or nil when
+// nobody is listening, in which case the collector marks itself stopped
+func wantedGroups() map[string]bool {
+	monitorHub.Lock()
+	defer monitorHub.Unlock()
+	if len(monitorHub.subs) == 0 {
+		monitorHub.running = false
+		return nil
+	}
+	wanted := make(map[string]bool)
+	for sub := range monitorHub.subs {
+		sub.mu.Lock()
+		for g := range sub.groups {
+			wanted[g] = true
+		}
+		sub.mu.Unlock()
+	}
+	return wanted
+}
+
+// publishMonitor sends each subscriber the groups it asked for
+func publishMonitor(snapshot map[string]interface{}) {
+	monitorHub.Lock()
+	defer monitorHub.Unlock()
+	for sub := range monitorHub.subs {
+		data := make(map[string]interface{})
+		for group, v := range snapshot {
+			if sub.wants(group) {
+				data[group] = v
+			}
+		}
+		payload := map[string]interface{}{"type": "update", "data": data}
+		select {
+		case <-sub.updates: // Drop the frame the client hasn't picked up yet
+		default:
+		}
+		sub.updates <- payload
+	}
+}
+
+type monitorProcInfo struct {
+	PID     int32   `json:"pid"`
+	User    string  `json:"user"`
+	CPU     float64 `json:"cpu"`
+	Mem     float32 `json:"mem"`
+	Command string  `json:"command"`
+}
+
+// monitorProc caches what doesn't change over a process's life
+type monitorProc struct {
+	proc     *process.Process
+	username string
+	name     string
+}
+
+// monitorCollector samples until no subscribers are left
+func monitorCollector() {
+	cpuUsage := &cpuTracker{}
+	cpuUsage.percent(false)
+	procCache := make(map[int32]*monitorProc)
+	var lastRx, lastTx uint64
+	var lastTime time.Time
+
+	for {
+		interval := getSettingInt("MONITOR_INTERVAL_SECONDS", defaultMonitorInterval)
+		if interval <= 0 {
+			interval = defaultMonitorInterval
+		}
+		time.Sleep(time.Duration(interval) * time.Second)
+
+		wanted := wantedGroups()
+		if wanted == nil {
+			return
+		}
+		now := time.Now()
+		snapshot := make(map[string]interface{})
+
+		if wanted["cpu"] {
+			usage := 0.0
+			if perc := cpuUsage.percent(false); len(perc) > 0 {
+				usage = perc[0]
+			}
+			snapshot["cpu"] = map[string]interface{}{"usage": usage}
+		}
+		if wanted["memory"] {
+			vMem, _ := mem.VirtualMemory()
+			if vMem != nil {
+				snapshot["memory"] = map[string]interface{}{"total": vMem.Total, "used": vMem.Used}
+			}
+		}
+		if wanted["disk"] {
+			dStat, _ := disk.Usage("/")
+			if dStat != nil {
+				snapshot["disk"] = map[string]interface{}{"total": dStat.Total, "used": dStat.Used}
+			}
+		}
+		if wanted["network"] {
+			rxRate, txRate := 0.0, 0.0
+			if netStat, err := net.IOCounters(false); err == nil && len(netStat) > 0 {
+				rx, tx := netStat[0].BytesRecv, netStat[0].BytesSent
+				if !lastTime.IsZero() && rx >= lastRx && tx >= lastTx {
+					if duration := now.Sub(lastTime).Seconds(); duration > 0 {
+						rxRate = float64(rx-lastRx) / duration
+						txRate = float64(tx-lastTx) / duration
+					}
+				}
+				lastRx, lastTx, lastTime = rx, tx, now
+			}
+			snapshot["network"] = map[string]interface{}{"rx_sec": rxRate, "tx_sec": txRate}
+		} else {
+			lastTime = time.Time{} // Rates restart when someone subscribes again
+		}
+		if wanted["system"] {
+			uptime, _ := host.Uptime()
+			lAvg, _ := load.Avg()
+			if lAvg == nil {
+				lAvg = &load.AvgStat{}
+			}
+			snapshot["system"] = map[string]interface{}{
+				"uptime": (time.Duration(uptime) * time.Second).String(),
+				"load":   fmt.Sprintf("%.2f %.2f %.2f", lAvg.Load1, lAvg.Load5, lAvg.Load15),
+			}
+		}
+		if wanted["processes"] {
+			snapshot["processes"] = topProcesses(procCache, 10)
+		} else if len(procCache) > 0 {
+			procCache = make(map[int32]*monitorProc) // CPU deltas are stale by now
+		}
+
+		publishMonitor(snapshot)
+	}
+}
+
+// topProcesses returns the n processes using the most CPU since the last call
+func topProcesses(cache map[int32]*monitorProc, n int) []monitorProcInfo {
+	pids, _ := process.Pids()
+	current := make(map[int32]bool, len(pids))
+	for _, pid := range pids {
+		current[pid] = true
+	}
+	for pid := range cache {
+		if !current[pid] {
+			delete(cache, pid)
+		}
+	}
+
+	procList := []monitorProcInfo{}
+	for _, pid := range pids {
+		p, exists := cache[pid]
+		if !exists {
+			proc, err := process.NewProcess(pid)
+			if err != nil {
+				continue
+			}
+			p = &monitorProc{proc: proc}
+			p.name, _ = proc.Name()
+			p.username, _ = proc.Username()
+			cache[pid] = p
+		}
+		cpuP, err := p.proc.CPUPercent()
+		if err != nil {
+			continue
+		}
+		memP, _ := p.proc.MemoryPercent()
+		procList = append(procList, monitorProcInfo{PID: pid, User: p.username, CPU: cpuP, Mem: memP, Command: p.name})
+	}
+
+	sort.Slice(procList, func(i, j int) bool { return procList[i].CPU > procList[j].CPU })
+	if len(procList) > n {
+		procList = procList[:n]
+	}
+	return procList
+}
+
+// ==================== MONITOR HANDLER ====================
+// Clients pick groups with ?groups=cpu,memory (default all) and can change
+// them later by sending {"type": "subscribe", "groups": [...]}.
+func handleMonitor(c *websocket.Conn) {
+	var groups []string
+	if q := c.Query("groups"); q != "" {
+		groups = strings.Split(q, ",")
+	}
+	sub := subscribeMonitor(groups)
+	defer unsubscribeMonitor(sub)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			_, msg, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			var req struct {
+				Type   string   `json:"type"`
+				Groups []string `json:"groups"`
+			}
+			if json.Unmarshal(msg, &req) == nil && req.Type == "subscribe" {
+				sub.setGroups(req.Groups)
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		case payload := <-sub.updates:
+			if err := c.WriteJSON(payload); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/shirou/gopsutil/v3/cpu"
+	"github.com/shirou/gopsutil/v3/disk"
+	"github.com/shirou/gopsutil/v3/host"
+	"github.com/shirou/gopsutil/v3/load"
+	"github.com/shirou/gopsutil/v3/mem"
+	psnet "github.com/shirou/gopsutil/v3/net"
+	"github.com/shirou/gopsutil/v3/process"
+)
+
+// ==================== PROMETHEUS EXPORTER ====================
+// GET /metrics serves the host metrics in the Prometheus text format (or
+// OpenMetrics when the scraper asks for it), named like node_exporter's so
+// existing dashboards work. Scrapers authenticate with METRICS_TOKEN as a
+// bearer token or come from an address in METRICS_ALLOWED_IPS; with neither
+// setting the endpoint is disabled.
+
+const (
+	prometheusContentType  = "text/plain; version=0.0.4; charset=utf-8"
+	openMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+// Pseudo and container filesystems that aren't worth exporting
+var ignoredFilesystems = map[string]bool{
+	"autofs": true, "binfmt_misc": true, "bpf": true, "cgroup": true, "cgroup2": true,
+	"configfs": true, "debugfs": true, "devpts": true, "devtmpfs": true, "fusectl": true,
+	"hugetlbfs": true, "mqueue": true, "nsfs": true, "overlay": true, "proc": true,
+	"pstore": true, "securityfs": true, "squashfs": true, "sysfs": true, "tracefs": true,
+}
+
+// metricsFamily is one metric name with its samples
+type metricsFamily struct {
+	Name    string
+	Help    string
+	Type    string // gauge or counter
+	samples []metricsSample
+}
+
+type metricsSample struct {
+	labels [][2]string
+	value  float64
+}
+
+// metricsWriter collects families in the order they are first written
+type metricsWriter struct {
+	families []*metricsFamily
+	byName   map[string]*metricsFamily
+}
+
+func (w *metricsWriter) add(name, typ, help string, value float64, labels ...string) {
+	if w.byName == nil {
+		w.byName = make(map[string]*metricsFamily)
+	}
+	f := w.byName[name]
+	if f == nil {
+		f = &metricsFamily{Name: name, Help: help, Type: typ}
+		w.byName[name] = f
+		w.families = append(w.families, f)
+	}
+	sample := metricsSample{value: value}
+	for i := 0; i+1 < len(labels); i += 2 {
+		sample.labels = append(sample.labels, [2]string{labels[i], labels[i+1]})
+	}
+	f.samples = append(f.samples, sample)
+}
+
+func (w *metricsWriter) gauge(name, help string, value float64, labels ...string) {
+	w.add(name, "gauge", help, value, labels...)
+}
+
+// counter takes the full sample name, ending in _total
+func (w *metricsWriter) counter(name, help string, value float64, labels ...string) {
+	w.add(name, "counter", help, value, labels...)
+}
+
+// render writes the exposition text. Counters keep their _total suffix on
+// samples in both formats; OpenMetrics drops it from the family name.
+func (w *metricsWriter) render(openMetrics bool) string {
+	var b strings.Builder
+	for _, f := range w.families {
+		family := f.Name
+		if openMetrics && f.Type == "counter" {
+			family = strings.TrimSuffix(family, "_total")
+		}
+		fmt.Fprintf(&b, "# HELP %s %s\n", family, f.Help)
+		fmt.Fprintf(&b, "# TYPE %s %s\n", family, f.Type)
+		for _, s := range f.samples {
+			b.WriteString(f.Name)
+			if len(s.labels) > 0 {
+				b.WriteByte('{')
+				for i, l := range s.labels {
+					if i > 0 {
+						b.WriteByte(',')
+					}
+					fmt.Fprintf(&b, "%s=\"%s\"", l[0], escapeLabelValue(l[1]))
+				}
+				b.WriteByte('}')
+			}
+			b.WriteByte(' ')
+			b.WriteString(strconv.FormatFloat(s.value, 'g', -1, 64))
+			b.WriteByte('\n')
+		}
+	}
+	if openMetrics {
+		b.WriteString("# EOF\n")
+	}
+	return b.String()
+}
+
+func escapeLabelValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(v)
+}
+
+// gatherHostMetrics reads everything /metrics exports
+func gatherHostMetrics() *metricsWriter {
+	w := &metricsWriter{}
+
+	if times, err := cpu.Times(true); err == nil {
+		for _, t := range times {
+			core := strings.TrimPrefix(t.CPU, "cpu")
+			for _, m := range []struct {
+				mode  string
+				value float64
+			}{
+				{"user", t.User}, {"nice", t.Nice}, {"system", t.System}, {"idle", t.Idle},
+				{"iowait", t.Iowait}, {"irq", t.Irq}, {"softirq", t.Softirq}, {"steal", t.Steal},
+			} {
+				w.counter("node_cpu_seconds_total", "Seconds the CPUs spent in each mode.", m.value, "cpu", core, "mode", m.mode)
+			}
+		}
+	}
+
+	if vMem, err := mem.VirtualMemory(); err == nil {
+		w.gauge("node_memory_MemTotal_bytes", "Memory information field MemTotal_bytes.", float64(vMem.Total))
+		w.gauge("node_memory_MemFree_bytes", "Memory information field MemFree_bytes.", float64(vMem.Free))
+		w.gauge("node_memory_MemAvailable_bytes", "Memory information field MemAvailable_bytes.", float64(vMem.Available))
+		w.gauge("node_memory_Buffers_bytes", "Memory information field Buffers_bytes.", float64(vMem.Buffers))
+		w.gauge("node_memory_Cached_bytes", "Memory information field Cached_bytes.", float64(vMem.Cached))
+	}
+	if swap, err := mem.SwapMemory(); err == nil {
+		w.gauge("node_memory_SwapTotal_bytes", "Memory information field SwapTotal_bytes.", float64(swap.Total))
+		w.gauge("node_memory_SwapFree_bytes", "Memory information field SwapFree_bytes.", float64(swap.Free))
+	}
+
+	if partitions, err := disk.Partitions(false); err == nil {
+		seen := make(map[string]bool)
+		for _, p := range partitions {
+			if ignoredFilesystems[p.Fstype] || seen[p.Mountpoint] {
+				continue
+			}
+			seen[p.Mountpoint] = true
+			usage, err := disk.Usage(p.Mountpoint)
+			if err != nil {
+				continue
+			}
+			labels := []string{"device", p.Device, "fstype", p.Fstype, "mountpoint", p.Mountpoint}
+			w.gauge("node_filesystem_size_bytes", "Filesystem size in bytes.", float64(usage.Total), labels...)
+			w.gauge("node_filesystem_free_bytes", "Filesystem free space in bytes.", float64(usage.Total-usage.Used), labels...)
+			w.gauge("node_filesystem_avail_bytes", "Filesystem space available to non-root users in bytes.", float64(usage.Free), labels...)
+			w.gauge("node_filesystem_files", "Filesystem total file nodes.", float64(usage.InodesTotal), labels...)
+			w.gauge("node_filesystem_files_free", "Filesystem total free file nodes.", float64(usage.InodesFree), labels...)
+		}
+	}
+	if counters, err := disk.IOCounters(); err == nil {
+		names := make([]string, 0, len(counters))
+		for name := range counters {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			d := counters[name]
+			w.counter("node_disk_reads_completed_total", "The total number of reads completed successfully.", float64(d.ReadCount), "device", name)
+			w.counter("node_disk_writes_completed_total", "The total number of writes completed successfully.", float64(d.WriteCount), "device", name)
+			w.counter("node_disk_read_bytes_total", "The total number of bytes read successfully.", float64(d.ReadBytes), "device", name)
+			w.counter("node_disk_written_bytes_total", "The total number of bytes written successfully.", float64(d.WriteBytes), "device", name)
+			w.counter("node_disk_io_time_seconds_total", "Total seconds spent doing I/Os.", float64(d.IoTime)/1000, "device", name)
+		}
+	}
+
+	if ifaces, err := psnet.IOCounters(true); err == nil {
+		for _, n := range ifaces {
+			w.counter("node_network_receive_bytes_total", "Network device statistic receive_bytes.", float64(n.BytesRecv), "device", n.Name)
+			w.counter("node_network_transmit_bytes_total", "Network device statistic transmit_bytes.", float64(n.BytesSent), "device", n.Name)
+			w.counter("node_network_receive_packets_total", "Network device statistic receive_packets.", float64(n.PacketsRecv), "device", n.Name)
+			w.counter("node_network_transmit_packets_total", "Network device statistic transmit_packets.", float64(n.PacketsSent), "device", n.Name)
+			w.counter("node_network_receive_errs_total", "Network device statistic receive_errs.", float64(n.Errin), "device", n.Name)
+			w.counter("node_network_transmit_errs_total", "Network device statistic transmit_errs.", float64(n.Errout), "device", n.Name)
+			w.counter("node_network_receive_drop_total", "Network device statistic receive_drop.", float64(n.Dropin), "device", n.Name)
+			w.counter("node_network_transmit_drop_total", "Network device statistic transmit_drop.", float64(n.Dropout), "device", n.Name)
+		}
+	}
+
+	if lAvg, err := load.Avg(); err == nil {
+		w.gauge("node_load1", "1m load average.", lAvg.Load1)
+		w.gauge("node_load5", "5m load average.", lAvg.Load5)
+		w.gauge("node_load15", "15m load average.", lAvg.Load15)
+	}
+	if misc, err := load.Misc(); err == nil {
+		w.gauge("node_procs_running", "Number of processes in runnable state.", float64(misc.ProcsRunning))
+		w.gauge("node_procs_blocked", "Number of processes blocked waiting for I/O to complete.", float64(misc.ProcsBlocked))
+	}
+	if pids, err := process.Pids(); err == nil {
+		w.gauge("vibeserver_processes", "Number of processes.", float64(len(pids)))
+	}
+	if boot, err := host.BootTime(); err == nil {
+		w.gauge("node_boot_time_seconds", "Node boot time, in unixtime.", float64(boot))
+	}
+	w.gauge("node_time_seconds", "System time in seconds since epoch (1970).", float64(time.Now().UnixNano())/1e9)
+
+	// One sample per state like node_exporter's systemd collector, so
+	// alerts can match on state="active" == 0
+	for _, s := range serviceStatuses() {
+		for _, state := range []string{"active", "activating", "deactivating", "inactive", "failed"} {
+			value := 0.0
+			if s.Status == state {
+				value = 1
+			}
+			w.gauge("vibeserver_service_state", "Tracked systemd service state.", value, "service", s.Name, "state", state)
+		}
+	}
+
+	monitorHub.Lock()
+	clients := len(monitorHub.subs)
+	monitorHub.Unlock()
+	w.gauge("vibeserver_monitor_clients", "Connected monitor dashboards.", float64(clients))
+	return w
+}
+
+// metricsAccess checks the bearer token (or ?token=) and the IP allowlist,
+// returning the HTTP status and message to refuse the scrape with
+func metricsAccess(c *fiber.Ctx) (int, string) {
+	token := getSetting("METRICS_TOKEN", "")
+	allowed := getSetting("METRICS_ALLOWED_IPS", "")
+	if token == "" && allowed == "" {
+		return fiber.StatusForbidden, "Metrics endpoint disabled, set METRICS_TOKEN or METRICS_ALLOWED_IPS"
+	}
+
+	if allowed != "" {
+		if ip := net.ParseIP(c.IP()); ip != nil && ipAllowed(ip, allowed) {
+			return fiber.StatusOK, ""
+		}
+	}
+	if token != "" {
+		given := strings.TrimPrefix(c.Get("Authorization"), "Bearer ")
+		if given == "" {
+			given = c.Query("token")
+		}
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1 {
+			return fiber.StatusOK, ""
+		}
+	}
+	return fiber.StatusUnauthorized, "Unauthorized"
+}
+
+// ipAllowed matches ip against a comma separated list of addresses and CIDRs
+func ipAllowed(ip net.IP, list string) bool {
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+		} else if allowedIP := net.ParseIP(entry); allowedIP != nil && allowedIP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// PrometheusMetrics serves GET /metrics
+func PrometheusMetrics(c *fiber.Ctx) error {
+	if status, msg := metricsAccess(c); status != fiber.StatusOK {
+		return c.Status(status).JSON(fiber.Map{"message": msg})
+	}
+	openMetrics := strings.Contains(c.Get("Accept"), "application/openmetrics-text")
+	body := gatherHostMetrics().render(openMetrics)
+	if openMetrics {
+		c.Set(fiber.HeaderContentType, openMetricsContentType)
+	} else {
+		c.Set(fiber.HeaderContentType, prometheusContentType)
+	}
+	return c.SendString(body)
+}
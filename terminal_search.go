@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ==================== TERMINAL SESSION SEARCH ====================
+// Recorded sessions are indexed in an FTS5 table so commands and output can be
+// searched across every session ("who ran rm -rf last week?").
+
+const maxSearchHits = 50
+
+func initTerminalSearch() {
+	err := DB.Exec(`CREATE VIRTUAL TABLE IF NOT EXISTS terminal_session_fts USING fts5(
+		commands, output, session_id UNINDEXED, tokenize = 'unicode61'
+	)`).Error
+	if err != nil {
+		log.Println("terminal search disabled: failed to create FTS index:", err)
+		return
+	}
+
+	// Backfill sessions recorded before the index existed
+	var pending []TerminalSession
+	DB.Where("id NOT IN (SELECT session_id FROM terminal_session_fts)").Find(&pending)
+	for i := range pending {
+		indexTerminalSession(&pending[i])
+	}
+}
+
+func indexTerminalSession(session *TerminalSession) {
+	// Index the commands as plain text so phrase queries match across the JSON quoting
+	var cmds []string
+	json.Unmarshal([]byte(session.Commands), &cmds)
+
+	DB.Exec("INSERT INTO terminal_session_fts (commands, output, session_id) VALUES (?, ?, ?)",
+		strings.Join(cmds, "\n"), session.Output, session.ID)
+}
+
+type SessionHit struct {
+	Field  string `json:"field"`  // "commands" or "output"
+	Offset int    `json:"offset"` // byte offset into the output, or command index
+	Length int    `json:"length"`
+}
+
+type SessionSearchResult struct {
+	SessionID uint         `json:"session_id"`
+	UserID    uint         `json:"user_id"`
+	Username  string       `json:"username"`
+	CreatedAt time.Time    `json:"created_at"`
+	EndedAt   time.Time    `json:"ended_at"`
+	Paths     []string     `json:"paths"`
+	Snippet   string       `json:"snippet"`
+	Hits      []SessionHit `json:"hits"`
+}
+
+// SearchTerminalSessions runs a full-text query over recorded sessions.
+// Query params: q (required), raw=true to pass FTS5 syntax through, user_id,
+// from/to (RFC3339 or YYYY-MM-DD), path (working directory prefix), limit.
+func SearchTerminalSessions(c *fiber.Ctx) error {
+	claims := c.Locals("user").(jwt.MapClaims)
+	role, _ := claims["role"].(string)
+	userIdFloat, _ := claims["iss"].(float64)
+
+	q := strings.TrimSpace(c.Query("q"))
+	if q == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "q required"})
+	}
+
+	match := q
+	if c.Query("raw") != "true" {
+		// Treat the query as a literal phrase
+		match = `"` + strings.ReplaceAll(q, `"`, `""`) + `"`
+	}
+
+	limit, _ := strconv.Atoi(c.Query("limit", "50"))
+	if limit <= 0 || limit > 200 {
+		limit = 50
+	}
+
+	query := DB.Table("terminal_session_fts").
+		Select("terminal_sessions.id, terminal_sessions.user_id, terminal_sessions.created_at, terminal_sessions.ended_at, terminal_sessions.paths, users.username, "+
+			"snippet(terminal_session_fts, -1, '[[', ']]', '…', 16) AS snippet").
+		Joins("JOIN terminal_sessions ON terminal_sessions.id = terminal_session_fts.session_id").
+		Joins("LEFT JOIN users ON users.id = terminal_sessions.user_id").
+		Where("terminal_session_fts MATCH ?", match)
+
+	// Non-admins only search their own sessions
+	if role != "admin" {
+		query = query.Where("terminal_sessions.user_id = ?", uint(userIdFloat))
+	} else if uid := c.Query("user_id"); uid != "" {
+		query = query.Where("terminal_sessions.user_id = ?", uid)
+	}
+
+	if from := c.Query("from"); from != "" {
+		t, err := parseSearchTime(from)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Invalid from date"})
+		}
+		query = query.Where("terminal_sessions.created_at >= ?", t)
+	}
+	if to := c.Query("to"); to != "" {
+		t, err := parseSearchTime(to)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Invalid to date"})
+		}
+		if len(to) == len("2006-01-02") {
+			t = t.Add(24 * time.Hour) // inclusive whole day
+		}
+		query = query.Where("terminal_sessions.created_at < ?", t)
+	}
+	if path := c.Query("path"); path != "" {
+		// paths is a JSON array: match an element equal to path or below it,
+		// so /var/www doesn't also match /var/www-old
+		quoted, _ := json.Marshal(strings.TrimSuffix(path, "/"))
+		escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(string(quoted[:len(quoted)-1]))
+		query = query.Where(`(terminal_sessions.paths LIKE ? ESCAPE '\' OR terminal_sessions.paths LIKE ? ESCAPE '\')`,
+			`%`+escaped+`"%`, `%`+escaped+`/%`)
+	}
+
+	var rows []struct {
+		ID        uint
+		UserID    uint
+		CreatedAt time.Time
+		EndedAt   time.Time
+		Paths     string
+		Username  string
+		Snippet   string
+	}
+	if err := query.Order("terminal_sessions.created_at desc").Limit(limit).Scan(&rows).Error; err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"message": "Search failed: " + err.Error()})
+	}
+
+	terms := searchTerms(q, c.Query("raw") == "true")
+
+	results := make([]SessionSearchResult, 0, len(rows))
+	for _, r := range rows {
+		var session TerminalSession
+		if err := DB.Select("id, commands, output").First(&session, r.ID).Error; err != nil {
+			continue
+		}
+		var paths, cmds []string
+		json.Unmarshal([]byte(r.Paths), &paths)
+		json.Unmarshal([]byte(session.Commands), &cmds)
+
+		results = append(results, SessionSearchResult{
+			SessionID: r.ID,
+			UserID:    r.UserID,
+			Username:  r.Username,
+			CreatedAt: r.CreatedAt,
+			EndedAt:   r.EndedAt,
+			Paths:     paths,
+			Snippet:   r.Snippet,
+			Hits:      findSessionHits(cmds, session.Output, terms),
+		})
+	}
+
+	return c.JSON(results)
+}
+
+func parseSearchTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", s, time.Local)
+}
+
+// searchTerms returns the literal strings to locate in the raw session text.
+// A phrase query is looked up as a whole; raw FTS queries fall back to their words.
+func searchTerms(q string, raw bool) []string {
+	if !raw {
+		return []string{q}
+	}
+	var terms []string
+	for _, f := range strings.Fields(q) {
+		f = strings.Trim(f, `"()*^`)
+		switch f {
+		case "", "AND", "OR", "NOT", "NEAR":
+			continue
+		}
+		terms = append(terms, f)
+	}
+	return terms
+}
+
+// findSessionHits reports where the terms occur so the player can seek to them:
+// byte offsets into Output and indexes into the command list.
+func findSessionHits(cmds []string, output string, terms []string) []SessionHit {
+	hits := []SessionHit{}
+	for _, term := range terms {
+		needle := asciiLower(term)
+		if needle == "" {
+			continue
+		}
+		for i, cmd := range cmds {
+			if strings.Contains(asciiLower(cmd), needle) {
+				hits = append(hits, SessionHit{Field: "commands", Offset: i, Length: len(cmd)})
+			}
+		}
+
+		haystack := asciiLower(output)
+		for start := 0; len(hits) < maxSearchHits; {
+			idx := strings.Index(haystack[start:], needle)
+			if idx < 0 {
+				break
+			}
+			hits = append(hits, SessionHit{Field: "output", Offset: start + idx, Length: len(needle)})
+			start += idx + len(needle)
+		}
+		if len(hits) >= maxSearchHits {
+			return hits[:maxSearchHits]
+		}
+	}
+	return hits
+}
+
+// asciiLower folds only ASCII letters so byte offsets stay aligned with the original text.
+func asciiLower(s string) string {
+	b := []byte(s)
+	for i, ch := range b {
+		if ch >= 'A' && ch <= 'Z' {
+			b[i] = ch + ('a' - 'A')
+		}
+	}
+	return string(b)
+}